@@ -5,40 +5,84 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"log"
-	"math"
 	mathrand "math/rand"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	protobuf "p2p_client/grpc"
 	"p2p_client/shared"
 
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/status"
 )
 
 var (
-	topic    = flag.String("topic", "", "topic name")
-	count    = flag.Int("count", 1, "number of messages to publish")
-	poisson  = flag.Bool("poisson", false, "Enable Poisson arrival")
-	dataSize = flag.Int("datasize", 100, "size of random of messages to publish")
-	sleep    = flag.Duration("sleep", 50*time.Millisecond, "optional delay between publishes (e.g., 1s, 500ms)")
-	ipfile   = flag.String("ipfile", "", "file with a list of IP addresses")
-	startIdx = flag.Int("start-index", 0, "beginning index is 0: default 0")
-	endIdx   = flag.Int("end-index", 10000, "index-1")
-	output   = flag.String("output", "", "file to write the outgoing data hashes")
+	topic       = flag.String("topic", "", "topic name")
+	topicsFlag  = flag.String("topics", "", "comma-separated topic names; each IP cycles through them one message at a time (overrides -topic)")
+	count       = flag.Int("count", 1, "number of messages to publish")
+	poisson     = flag.Bool("poisson", false, "Enable Poisson arrival")
+	jitter      = flag.Float64("jitter", 0, "randomize each -sleep uniformly within ±jitter*sleep, e.g. 0.2 (0 disables; 0-1)")
+	dataSize    = flag.Int("datasize", 100, "size of random of messages to publish")
+	seed        = flag.Int64("seed", 0, "seed payload contents and -poisson/-jitter intervals for reproducible runs (0 uses fresh randomness)")
+	sleep       = flag.Duration("sleep", 50*time.Millisecond, "optional delay between publishes (e.g., 1s, 500ms)")
+	publishRate = flag.Float64("rate", 0, "network-wide publish rate cap in messages/sec shared by all IPs (0 uses -sleep per IP)")
+	ipfile      = flag.String("ipfile", "", "file with a list of IP addresses")
+	defaultPort = flag.String("default-port", "33212", "port appended to ipfile entries that have none (empty rejects them)")
+	startIdx    = flag.Int("start-index", 0, "beginning index is 0: default 0")
+	endIdx      = flag.Int("end-index", 10000, "index-1")
+	output      = flag.String("output", "", "file to write the outgoing data hashes")
+	rotateBytes = flag.Int64("rotate-bytes", 0, "start a new output file segment after this many bytes (0 disables rotation)")
+	gzipOutput  = flag.Bool("gzip", false, "gzip-compress output files (implied by a .gz filename)")
+	compress    = flag.String("compress", "", "compress publish requests on the wire: gzip (empty disables)")
+	manifest    = flag.String("manifest", "", "file to write the run parameters to as JSON (default: manifest.json next to -output, none without -output)")
+	metricsAddr = flag.String("metrics-addr", "", "serve Prometheus metrics on this address, e.g. :9100 (disabled when empty)")
+
+	keepaliveInterval = flag.Duration("keepalive-interval", 2*time.Minute, "interval between gRPC keepalive pings")
+	keepaliveTimeout  = flag.Duration("keepalive-timeout", 20*time.Second, "time to wait for a keepalive ping ack before closing the connection")
+	dialTimeout       = flag.Duration("dial-timeout", 10*time.Second, "give up on a node that is not connected within this long (0 waits for the OS TCP timeout)")
+
+	logLevel = flag.String("log-level", "info", "minimum log level: debug | info | warn | error")
+	verbose  = flag.Bool("v", false, "log every message sent or received (same as -log-level=debug)")
+
+	tlsFlags = shared.RegisterTLSFlags(flag.CommandLine)
+
+	// transportCreds is built from tlsFlags once flags are parsed.
+	transportCreds grpc.DialOption
+	// topics is -topics, or just -topic when -topics is empty.
+	topics []string
 )
 
 func main() {
 	flag.Parse()
-	if *topic == "" {
-		log.Fatal("-topic is required")
+	if err := shared.ConfigureLogging(*logLevel, *verbose); err != nil {
+		log.Fatal(err)
+	}
+	creds, err := tlsFlags.DialOption()
+	if err != nil {
+		log.Fatal(err)
+	}
+	transportCreds = creds
+	topics = splitTopics(*topicsFlag)
+	if len(topics) == 0 && *topic != "" {
+		topics = []string{*topic}
+	}
+	if len(topics) == 0 {
+		log.Fatal("-topic or -topics is required")
 	}
 	if *count < 1 {
 		log.Fatal("-count must be >= 1")
@@ -46,20 +90,30 @@ func main() {
 	if *dataSize < 1 {
 		log.Fatal("-datasize must be >= 1")
 	}
+	if *compress != "" && *compress != gzip.Name {
+		log.Fatalf("unknown -compress %q (want gzip)", *compress)
+	}
+	if *jitter < 0 || *jitter > 1 {
+		log.Fatal("-jitter must be between 0 and 1")
+	}
+	if *jitter > 0 && (*poisson || *publishRate > 0) {
+		log.Fatal("-jitter only applies to fixed -sleep publishing, not -poisson or -rate")
+	}
 
-	_ips, err := shared.ReadIPsFromFile(*ipfile)
+	_ips, err := shared.ReadIPsFromFile(*ipfile, *defaultPort)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		shared.Log.Errorf("%v", err)
 		return
 	}
-	fmt.Printf("numip %d  index %d\n", len(_ips), *endIdx)
+	shared.Log.Debugf("numip %d  index %d", len(_ips), *endIdx)
 	*endIdx = min(len(_ips), *endIdx)
 	if *startIdx < 0 || *startIdx >= *endIdx || *startIdx >= len(_ips) {
 		log.Fatalf("invalid index range: start-index=%d end-index=%d (num IPs=%d)", *startIdx, *endIdx, len(_ips))
 	}
 
 	ips := _ips[*startIdx:*endIdx]
-	fmt.Printf("Found %d IPs: %v\n", len(ips), ips)
+	shared.Log.Infof("Found %d IPs", len(ips))
+	shared.Log.Debugf("IPs: %v", ips)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -67,10 +121,14 @@ func main() {
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		fmt.Println("\nShutting down gracefully…")
+		shared.Log.Infof("Shutting down gracefully…")
 		cancel()
 	}()
 
+	writerOpts := shared.DefaultFileWriterOptions
+	writerOpts.RotateBytes = *rotateBytes
+	writerOpts.Gzip = *gzipOutput
+
 	dataCh := make(chan string, 100)
 	randomByteLen := max(1, *dataSize/2)
 	var done chan bool
@@ -79,59 +137,325 @@ func main() {
 
 	if *output != "" {
 		done = make(chan bool)
-		header := "sender\tsize\tsha256(msg)"
-		go shared.WriteToFile(ctx, dataCh, done, *output, header)
+		header := outputHeader
+		go shared.WriteToFileWithOptions(ctx, dataCh, done, *output, header, writerOpts)
 	}
 
+	var limiter *rate.Limiter
+	if *publishRate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(*publishRate), 1)
+	}
+
+	stats := newPublishStats(ips)
+	if *metricsAddr != "" {
+		stats.metrics = shared.NewMetrics()
+		if err := shared.ServeMetrics(*metricsAddr, stats.metrics); err != nil {
+			log.Fatal(err)
+		}
+	}
+	start := time.Now()
+	if path := manifestPath(*manifest, *output); path != "" {
+		if err := writeManifest(path, ips, start); err != nil {
+			log.Fatalf("write manifest: %v", err)
+		}
+		shared.Log.Infof("Wrote run manifest to %s", path)
+	}
 	for _, ip := range ips {
 		wg.Add(1)
 		go func(ip string) {
 			defer wg.Done()
-			if err := sendMessages(ctx, ip, randomByteLen, *output != "", dataCh); err != nil {
+			if err := sendMessages(ctx, ip, randomByteLen, *output != "", dataCh, limiter, stats); err != nil {
+				stats.failed(ip)
 				errCh <- err
 				cancel()
 			}
 		}(ip)
 	}
 	wg.Wait()
+	stats.print(time.Since(start))
 	close(errCh)
 	close(dataCh)
 	if done != nil {
 		<-done
 	}
 
-	hasErrors := false
+	hasErrors := stats.failedIPs.Load() > 0
 	for err := range errCh {
 		hasErrors = true
-		log.Printf("publish worker error: %v", err)
+		shared.Log.Errorf("publish worker error: %v", err)
 	}
 	if hasErrors {
 		os.Exit(1)
 	}
 }
 
-func sendMessages(ctx context.Context, ip string, datasize int, write bool, dataCh chan<- string) error {
+// outputHeader names the -output columns. Every row written by sendMessages
+// has exactly these fields; timestamp is the unix-nanosecond send time and
+// topic the one the message was published to. New columns go at the end, so
+// readers of the original sender, size and hash columns keep working.
+const outputHeader = "sender\tsize\t" + shared.HashColumn + "\ttimestamp\ttopic"
+
+// compressProbeTimeout is how long the first message on a compressed stream
+// waits for the sidecar to reject the compression. The sidecar sends nothing
+// back for an accepted publish, so a stream that is still open by then is
+// taken to accept it.
+const compressProbeTimeout = 2 * time.Second
+
+// closeGrace is how long a half-closed publish stream may take to be closed
+// by the sidecar before the connection is dropped.
+const closeGrace = 2 * time.Second
+
+// streamWatch receives on a publish stream, discarding anything the sidecar
+// sends, until the stream ends. It is the only reader of the stream.
+type streamWatch struct {
+	done chan struct{}
+	err  error // the stream's final status, set before done is closed
+}
+
+func watchStream(stream protobuf.CommandStream_ListenCommandsClient) *streamWatch {
+	w := &streamWatch{done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		for {
+			if _, err := stream.Recv(); err != nil {
+				w.err = err
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// compressionRejected waits up to compressProbeTimeout for the sidecar to
+// end the watched stream because it cannot decompress the requests. It
+// returns false if the stream is still open by then or ctx is done first.
+func compressionRejected(ctx context.Context, w *streamWatch) bool {
+	timer := time.NewTimer(compressProbeTimeout)
+	defer timer.Stop()
+	select {
+	case <-w.done:
+		return status.Code(w.err) == codes.Unimplemented
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// runManifest records the parameters of a publish run so that its output
+// files are self-describing.
+type runManifest struct {
+	Tool       string    `json:"tool"`
+	Topic      string    `json:"topic,omitempty"`
+	Topics     []string  `json:"topics,omitempty"`
+	Count      int       `json:"count"`
+	DataSize   int       `json:"datasize"`
+	Sleep      string    `json:"sleep"`
+	Rate       float64   `json:"rate"`
+	Poisson    bool      `json:"poisson"`
+	Seed       int64     `json:"seed,omitempty"`
+	IPFile     string    `json:"ipfile"`
+	StartIndex int       `json:"startIndex"`
+	EndIndex   int       `json:"endIndex"`
+	IPs        []string  `json:"ips"`
+	Output     string    `json:"output,omitempty"`
+	StartTime  time.Time `json:"startTime"`
+}
+
+// manifestPath returns the -manifest file, defaulting to manifest.json in
+// the directory of -output.
+func manifestPath(manifest, output string) string {
+	if manifest != "" || output == "" {
+		return manifest
+	}
+	return filepath.Join(filepath.Dir(output), "manifest.json")
+}
+
+func writeManifest(path string, ips []string, start time.Time) error {
+	m := runManifest{
+		Tool:       "p2p-multi-publish",
+		Count:      *count,
+		DataSize:   *dataSize,
+		Sleep:      sleep.String(),
+		Rate:       *publishRate,
+		Poisson:    *poisson,
+		Seed:       *seed,
+		IPFile:     *ipfile,
+		StartIndex: *startIdx,
+		EndIndex:   *endIdx,
+		IPs:        ips,
+		Output:     *output,
+		StartTime:  start,
+	}
+	// A single topic keeps the original "topic" field.
+	if len(topics) == 1 {
+		m.Topic = topics[0]
+	} else {
+		m.Topics = topics
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// publishStats accumulates what every sendMessages goroutine put on the wire,
+// in total and per IP, and the IPs it could not connect to. Sends are also
+// counted in metrics when -metrics-addr is set.
+type publishStats struct {
+	messages  atomic.Int64
+	bytes     atomic.Int64
+	failedIPs atomic.Int64
+	metrics   *shared.Metrics
+
+	mu    sync.Mutex
+	perIP map[string]*ipResult
+}
+
+// ipResult is one IP's row of the per-IP summary.
+type ipResult struct {
+	messages int
+	bytes    int64
+	errors   int
+	sendTime time.Duration
+}
+
+// newPublishStats returns stats with a row for every IP, so that IPs which
+// never sent anything still appear in the per-IP summary.
+func newPublishStats(ips []string) *publishStats {
+	s := &publishStats{perIP: make(map[string]*ipResult, len(ips))}
+	for _, ip := range ips {
+		s.perIP[ip] = &ipResult{}
+	}
+	return s
+}
+
+// add records one message of size bytes sent to ip whose Send took sendTime.
+func (s *publishStats) add(ip string, size int, sendTime time.Duration) {
+	s.messages.Add(1)
+	s.bytes.Add(int64(size))
+	s.metrics.MessageSent(size)
+
+	s.mu.Lock()
+	r := s.perIP[ip]
+	r.messages++
+	r.bytes += int64(size)
+	r.sendTime += sendTime
+	s.mu.Unlock()
+}
+
+// failed counts an error that stopped ip's publisher.
+func (s *publishStats) failed(ip string) {
+	s.mu.Lock()
+	s.perIP[ip].errors++
+	s.mu.Unlock()
+}
+
+// connFailed records an IP that could not be connected to. Unlike a failed
+// send, it does not stop the other IPs.
+func (s *publishStats) connFailed(ip string, err error) {
+	s.failedIPs.Add(1)
+	s.failed(ip)
+	shared.Log.Errorf("[%s] %v; skipping this IP", ip, err)
+}
+
+func (s *publishStats) print(elapsed time.Duration) {
+	msgs, bytes := s.messages.Load(), s.bytes.Load()
+	secs := elapsed.Seconds()
+	var msgRate, mbRate float64
+	if secs > 0 {
+		msgRate = float64(msgs) / secs
+		mbRate = float64(bytes) / secs / 1e6
+	}
+	fmt.Println("\nPublish summary:")
+	fmt.Printf("  messages: %d\n", msgs)
+	fmt.Printf("  bytes:    %d\n", bytes)
+	fmt.Printf("  elapsed:  %v\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("  rate:     %.1f msg/s, %.3f MB/s\n", msgRate, mbRate)
+	fmt.Printf("  failed:   %d IP(s)\n", s.failedIPs.Load())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ips := make([]string, 0, len(s.perIP))
+	for ip := range s.perIP {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	fmt.Println("\nPer-IP summary:")
+	fmt.Printf("  %-28s %10s %12s %7s %12s\n", "IP", "MESSAGES", "BYTES", "ERRORS", "AVG SEND")
+	for _, ip := range ips {
+		r := s.perIP[ip]
+		avg := "-"
+		if r.messages > 0 {
+			avg = (r.sendTime / time.Duration(r.messages)).Round(time.Microsecond).String()
+		}
+		fmt.Printf("  %-28s %10d %12d %7d %12s\n", ip, r.messages, r.bytes, r.errors, avg)
+	}
+}
+
+// sendMessages publishes *count messages to ip. When limiter is non-nil every
+// send waits for a token from it instead of sleeping between messages.
+func sendMessages(ctx context.Context, ip string, datasize int, write bool, dataCh chan<- string, limiter *rate.Limiter, stats *publishStats) error {
 	// Create connection once and reuse for all messages
-	conn, err := grpc.NewClient(ip,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithDefaultCallOptions(
-			grpc.MaxCallRecvMsgSize(math.MaxInt),
-			grpc.MaxCallSendMsgSize(math.MaxInt),
-		),
+	conn, client, err := shared.NewStreamClient(ctx, ip,
+		shared.WithCredentials(transportCreds),
+		shared.WithKeepalive(*keepaliveInterval, *keepaliveTimeout),
+		shared.WithDialTimeout(*dialTimeout),
 	)
 	if err != nil {
-		return fmt.Errorf("[%s] failed to connect to node: %w", ip, err)
+		if ctx.Err() == nil {
+			stats.connFailed(ip, err)
+		}
+		return nil
 	}
 	defer conn.Close()
 
-	client := protobuf.NewCommandStreamClient(conn)
-	stream, err := client.ListenCommands(ctx)
+	// The stream gets its own context so that cancelling ctx on SIGINT cannot
+	// abort a Send that is already in progress; ctx is only checked between
+	// messages, and every message that was sent is still written to dataCh.
+	streamCtx, streamCancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer streamCancel()
+
+	var callOpts []grpc.CallOption
+	if *compress != "" {
+		callOpts = append(callOpts, grpc.UseCompressor(*compress))
+	}
+	stream, err := client.ListenCommands(streamCtx, callOpts...)
 	if err != nil {
-		return fmt.Errorf("[%s] ListenCommands failed: %w", ip, err)
+		stats.connFailed(ip, fmt.Errorf("ListenCommands failed: %w", err))
+		return nil
 	}
+	// The stream is shared by every message below and half-closed once they
+	// are all sent. The connection is then kept until the sidecar has closed
+	// the stream too, or for closeGrace, so the last messages still buffered
+	// are not dropped with it.
+	watch := watchStream(stream)
+	defer func() {
+		_ = stream.CloseSend()
+		select {
+		case <-watch.done:
+		case <-time.After(closeGrace):
+		}
+	}()
 
-	println(fmt.Sprintf("Connected to node at: %s…", ip))
+	shared.Log.Infof("Connected to node at: %s…", ip)
 
+	// rng drives the pacing intervals and, with -seed, the payload contents.
+	// A seeded rng is derived from -seed and ip, so every IP publishes the
+	// same bytes on every run however the goroutines interleave. Without
+	// -seed the clock is mixed with ip too, so goroutines that start in the
+	// same clock tick still get different streams.
+	runSeed := *seed
+	if runSeed == 0 {
+		runSeed = time.Now().UnixNano()
+	}
+	rng := mathrand.New(mathrand.NewSource(ipSeed(runSeed, ip)))
+
+	// probing is set until the first message on a compressed stream has
+	// shown whether the sidecar accepts the compression. Nothing further is
+	// sent, counted or written until then.
+	probing := len(callOpts) > 0
 	for i := 0; i < *count; i++ {
 		select {
 		case <-ctx.Done():
@@ -141,40 +465,97 @@ func sendMessages(ctx context.Context, ip string, datasize int, write bool, data
 
 		start := time.Now()
 		randomBytes := make([]byte, datasize)
-		if _, err := rand.Read(randomBytes); err != nil {
+		if *seed != 0 {
+			_, _ = rng.Read(randomBytes)
+		} else if _, err := rand.Read(randomBytes); err != nil {
 			return fmt.Errorf("[%s] failed to generate random bytes: %w", ip, err)
 		}
 
 		randomSuffix := hex.EncodeToString(randomBytes)
-		data := []byte(fmt.Sprintf("%s-%s", ip, randomSuffix))
+		data := shared.EncodePayload(shared.PayloadHeader{Seq: uint64(i), Publisher: ip}, []byte(randomSuffix))
+		t := topics[i%len(topics)]
 		pubReq := &protobuf.Request{
 			Command: int32(shared.CommandPublishData),
-			Topic:   *topic,
+			Topic:   t,
 			Data:    data,
 		}
 
-		if err := stream.Send(pubReq); err != nil {
+		if limiter != nil {
+			if err := limiter.Wait(ctx); err != nil {
+				return nil
+			}
+		}
+
+		sentAt := time.Now()
+		err := stream.Send(pubReq)
+		sendTime := time.Since(sentAt)
+		if probing {
+			probing = false
+			if compressionRejected(ctx, watch) {
+				// The sidecar dropped the message; resend it uncompressed
+				// on a new stream.
+				shared.Log.Warnf("[%s] sidecar does not accept %s compression; continuing uncompressed", ip, *compress)
+				stream, err = client.ListenCommands(streamCtx)
+				if err != nil {
+					return fmt.Errorf("[%s] ListenCommands failed: %w", ip, err)
+				}
+				watch = watchStream(stream)
+				sentAt = time.Now()
+				err = stream.Send(pubReq)
+				sendTime = time.Since(sentAt)
+			} else if ctx.Err() != nil {
+				// Interrupted before the message was confirmed, so it is
+				// not recorded as published.
+				return nil
+			}
+		}
+		if err != nil {
 			return fmt.Errorf("[%s] send publish: %w", ip, err)
 		}
+		stats.add(ip, len(data), sendTime)
 
 		elapsed := time.Since(start)
 		hash := sha256.Sum256(data)
 		hexHashString := hex.EncodeToString(hash[:])
 		if write {
-			dataToSend := fmt.Sprintf("%s\t%d\t%s", ip, len(data), hexHashString)
+			dataToSend := fmt.Sprintf("%s\t%d\t%s\t%d\t%s", ip, len(data), hexHashString, sentAt.UnixNano(), t)
 			dataCh <- dataToSend
 		}
-		fmt.Printf("[%s] published %d bytes to %q (took %v)\n", ip, len(data), *topic, elapsed)
+		shared.Log.Debugf("[%s] published %d bytes to %q (took %v)", ip, len(data), t, elapsed)
 
+		if limiter != nil {
+			continue
+		}
+		waitTime := *sleep
 		if *poisson {
 			lambda := 1.0 / (*sleep).Seconds()
-			interval := mathrand.ExpFloat64() / lambda
-			waitTime := time.Duration(interval * float64(time.Second))
-			time.Sleep(waitTime)
-		} else {
-			time.Sleep(*sleep)
+			interval := rng.ExpFloat64() / lambda
+			waitTime = time.Duration(interval * float64(time.Second))
+		} else if *jitter > 0 {
+			offset := (2*rng.Float64() - 1) * *jitter * float64(*sleep)
+			waitTime = *sleep + time.Duration(offset)
+		}
+		if !shared.Sleep(ctx, waitTime) {
+			return nil
 		}
 	}
 
 	return nil
 }
+
+// ipSeed derives the seed of ip's payload source from the -seed value.
+func ipSeed(seed int64, ip string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(ip))
+	return seed ^ int64(h.Sum64())
+}
+
+func splitTopics(s string) []string {
+	var out []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			out = append(out, t)
+		}
+	}
+	return out
+}
@@ -2,97 +2,318 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"math"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	protobuf "p2p_client/grpc"
 	"p2p_client/shared"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 var (
-	topic       = flag.String("topic", "", "topic name")
-	ipfile      = flag.String("ipfile", "", "file with a list of IP addresses")
-	startIdx    = flag.Int("start-index", 0, "beginning index is 0: default 0")
-	endIdx      = flag.Int("end-index", 10000, "index-1")
-	outputTrace = flag.String("output-trace", "", "file to write the outgoing data hashes")
-	outputData  = flag.String("output-data", "", "file to write the outgoing data hashes")
+	topic            = flag.String("topic", "", "topic name")
+	ipfile           = flag.String("ipfile", "", "file with a list of IP addresses")
+	defaultPort      = flag.String("default-port", "33212", "port appended to ipfile entries that have none (empty rejects them)")
+	startIdx         = flag.Int("start-index", 0, "beginning index is 0: default 0")
+	endIdx           = flag.Int("end-index", 10000, "index-1")
+	outputTrace      = flag.String("output-trace", "", "file to write the outgoing data hashes")
+	outputData       = flag.String("output-data", "", "file to write the outgoing data hashes")
+	outputDir        = flag.String("output-dir", "", "directory to write one data file per IP to, instead of a single -output-data file")
+	outputCombined   = flag.String("output-combined", "", "file to write data and trace records to in received order, each prefixed with DATA or TRACE (excludes -output-data and -output-trace)")
+	rotateBytes      = flag.Int64("rotate-bytes", 0, "start a new output file segment after this many bytes (0 disables rotation)")
+	gzipOutput       = flag.Bool("gzip", false, "gzip-compress output files (implied by a .gz filename)")
+	dumpPayloads     = flag.String("dump-payloads", "", "directory to write each received payload to, one file per sha256")
+	dedupe           = flag.Bool("dedupe", false, "count and write each unique message payload only once across all IPs")
+	traceTopic       = flag.String("trace-topic", "", "only emit trace events for this topic")
+	traceNoTopic     = flag.Bool("trace-keep-untopiced", true, "with -trace-topic, still emit trace events that carry no topic")
+	traceFormat      = flag.String("trace-format", shared.TraceFormatTSV, "trace output format: tsv | json")
+	traceHuman       = flag.Bool("trace-human-time", false, "write trace timestamps as RFC3339 instead of unix nanoseconds")
+	shardStats       = flag.Bool("shard-stats", false, "print per-message OptimumP2P shard statistics at shutdown")
+	receivedFromCol  = flag.Bool("received-from", false, "append a received_from column to the data output with the peer each node got the message from, taken from its trace events")
+	metricsAddr      = flag.String("metrics-addr", "", "serve Prometheus metrics on this address, e.g. :9100 (disabled when empty)")
+	preflightTimeout = flag.Duration("preflight-timeout", 2*time.Second, "TCP-probe every IP with this timeout before subscribing and skip unreachable ones (0 disables the probe)")
+	duration         = flag.Duration("duration", 0, "stop after subscribing for this long (0 runs until interrupted)")
+	maxMessages      = flag.Uint64("max-messages", 0, "stop once this many messages have been received across all IPs (0 means no limit)")
+	progressInterval = flag.Duration("progress-interval", 10*time.Second, "log the total received and messages/sec across all IPs this often (0 disables)")
+	maxConns         = flag.Int("max-conns", 0, "maximum number of simultaneous node connections; the rest wait for a free slot (0 means no limit)")
+	stateFile        = flag.String("state-file", "", "file to record the index after the last fully-processed IP in, for -resume")
+	resume           = flag.Bool("resume", false, "start at the index recorded in -state-file if it is past -start-index")
+
+	keepaliveInterval = flag.Duration("keepalive-interval", 2*time.Minute, "interval between gRPC keepalive pings")
+	keepaliveTimeout  = flag.Duration("keepalive-timeout", 20*time.Second, "time to wait for a keepalive ping ack before closing the connection")
+	dialTimeout       = flag.Duration("dial-timeout", 10*time.Second, "give up on a node that is not connected within this long (0 waits for the OS TCP timeout)")
+
+	logLevel = flag.String("log-level", "info", "minimum log level: debug | info | warn | error")
+	verbose  = flag.Bool("v", false, "log every message sent or received (same as -log-level=debug)")
+
+	tlsFlags = shared.RegisterTLSFlags(flag.CommandLine)
+
+	// transportCreds is built from tlsFlags once flags are parsed.
+	transportCreds grpc.DialOption
 )
 
 func main() {
 	flag.Parse()
+	if err := shared.ConfigureLogging(*logLevel, *verbose); err != nil {
+		log.Fatal(err)
+	}
+	creds, err := tlsFlags.DialOption()
+	if err != nil {
+		log.Fatal(err)
+	}
+	transportCreds = creds
 	if *topic == "" {
 		log.Fatal("-topic is required")
 	}
+	if *traceFormat != shared.TraceFormatTSV && *traceFormat != shared.TraceFormatJSON {
+		log.Fatalf("unknown -trace-format %q", *traceFormat)
+	}
+	if *maxConns < 0 {
+		log.Fatal("-max-conns must be >= 0")
+	}
+	if *outputCombined != "" && (*outputData != "" || *outputTrace != "") {
+		log.Fatal("-output-combined cannot be used with -output-data or -output-trace")
+	}
+	if *outputDir != "" && (*outputData != "" || *outputCombined != "") {
+		log.Fatal("-output-dir cannot be used with -output-data or -output-combined")
+	}
 
-	_ips, err := shared.ReadIPsFromFile(*ipfile)
+	_ips, err := shared.ReadIPsFromFile(*ipfile, *defaultPort)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		shared.Log.Errorf("%v", err)
 		return
 	}
-	fmt.Printf("numip %d  index %d\n", len(_ips), *endIdx)
+	shared.Log.Debugf("numip %d  index %d", len(_ips), *endIdx)
 	*endIdx = min(len(_ips), *endIdx)
+	if *resume {
+		if *stateFile == "" {
+			log.Fatal("-resume requires -state-file")
+		}
+		next, ok, err := readResumeIndex(*stateFile, *ipfile)
+		if err != nil {
+			log.Fatalf("-resume: %v", err)
+		}
+		if ok && next > *startIdx {
+			if next >= *endIdx {
+				shared.Log.Infof("-resume: every IP before end-index %d was already processed (%s)", *endIdx, *stateFile)
+				return
+			}
+			shared.Log.Infof("Resuming at index %d from %s", next, *stateFile)
+			*startIdx = next
+		}
+	}
 	if *startIdx < 0 || *startIdx >= *endIdx || *startIdx >= len(_ips) {
 		log.Fatalf("invalid index range: start-index=%d end-index=%d (num IPs=%d)", *startIdx, *endIdx, len(_ips))
 	}
 
 	ips := _ips[*startIdx:*endIdx]
-	fmt.Printf("Found %d IPs: %v\n", len(ips), ips)
+	shared.Log.Infof("Found %d IPs", len(ips))
+	shared.Log.Debugf("IPs: %v", ips)
+
+	// indices holds the ipfile index of each entry of ips.
+	indices := make([]int, len(ips))
+	for i := range indices {
+		indices[i] = *startIdx + i
+	}
+
+	var prog *progress
+	if *stateFile != "" {
+		prog, err = newProgress(*stateFile, *ipfile, *startIdx)
+		if err != nil {
+			log.Fatalf("-state-file: %v", err)
+		}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	// stopped is set when -duration or -max-messages ends the run. IPs served
+	// until then are recorded as processed in -state-file; IPs still
+	// subscribed on Ctrl-C or after another IP failed are not.
+	var stopped atomic.Bool
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		fmt.Println("\nShutting down gracefully…")
+		shared.Log.Infof("Shutting down gracefully…")
 		cancel()
 	}()
 
+	if *preflightTimeout > 0 {
+		reachable, unreachable := preflight(ctx, ips, *preflightTimeout)
+		shared.Log.Infof("Preflight: %d reachable, %d unreachable of %d IPs", len(reachable), len(unreachable), len(ips))
+		if len(unreachable) > 0 {
+			skipped := make([]string, len(unreachable))
+			for k, i := range unreachable {
+				skipped[k] = ips[i]
+				// Skipped IPs must not hold back the -resume index.
+				prog.finish(indices[i])
+			}
+			shared.Log.Warnf("Skipping unreachable IPs: %v", skipped)
+		}
+		if len(reachable) == 0 {
+			log.Fatal("no reachable IPs")
+		}
+		kept, keptIndices := make([]string, len(reachable)), make([]int, len(reachable))
+		for k, i := range reachable {
+			kept[k], keptIndices[k] = ips[i], indices[i]
+		}
+		ips, indices = kept, keptIndices
+	}
+
+	writerOpts := shared.DefaultFileWriterOptions
+	writerOpts.RotateBytes = *rotateBytes
+	writerOpts.Gzip = *gzipOutput
+
 	dataCh := make(chan string, 100)
 	traceCh := make(chan string, 100)
 	var dataDone chan bool
 	var traceDone chan bool
 	errCh := make(chan error, len(ips))
 
+	header := dataHeader
+	if *receivedFromCol {
+		header += "\t" + shared.ReceivedFromColumn
+	}
+
 	var wg sync.WaitGroup
 	if *outputData != "" {
 		dataDone = make(chan bool)
-		header := "receiver\tsender\tsize\tsha256(msg)"
-		go shared.WriteToFile(ctx, dataCh, dataDone, *outputData, header)
+		go shared.WriteToFileWithOptions(ctx, dataCh, dataDone, *outputData, header, writerOpts)
 	}
 
 	if *outputTrace != "" {
 		traceDone = make(chan bool)
-		header := ""
-		go shared.WriteToFile(ctx, traceCh, traceDone, *outputTrace, header)
+		go shared.WriteToFileWithOptions(ctx, traceCh, traceDone, *outputTrace, "", writerOpts)
+	}
+
+	// With -output-combined both record kinds go through one channel, so the
+	// file keeps the order in which they were received.
+	if *outputCombined != "" {
+		traceCh = dataCh
+		dataDone = make(chan bool)
+		go shared.WriteToFileWithOptions(ctx, dataCh, dataDone, *outputCombined, "", writerOpts)
+	}
+	if *outputDir != "" {
+		if err := os.MkdirAll(*outputDir, 0o755); err != nil {
+			log.Fatalf("-output-dir: %v", err)
+		}
 	}
+	writeData := *outputData != "" || *outputCombined != "" || *outputDir != ""
+	writeTrace := *outputTrace != "" || *outputCombined != ""
 
-	for _, ip := range ips {
+	tracker := &shared.Tracker{
+		Sequences:  shared.NewSequenceTracker(),
+		TagRecords: *outputCombined != "",
+		Trace: &shared.TraceOptions{Topic: *traceTopic, KeepUntopiced: *traceNoTopic,
+			Format: *traceFormat, HumanTime: *traceHuman, TagRecords: *outputCombined != ""},
+	}
+	if *dumpPayloads != "" {
+		if err := os.MkdirAll(*dumpPayloads, 0o755); err != nil {
+			log.Fatalf("-dump-payloads: %v", err)
+		}
+		tracker.DumpDir = *dumpPayloads
+	}
+	if *dedupe {
+		tracker.Dedupe = shared.NewHashSet()
+		tracker.Duplicates = shared.NewKeyCounter()
+	}
+	if *shardStats {
+		tracker.Trace.Shards = shared.NewShardStats()
+	}
+	if *receivedFromCol {
+		tracker.Hops = shared.NewHopIndex()
+	}
+	// Metrics are always collected so that decode errors can be reported at
+	// shutdown; -metrics-addr only controls whether they are served.
+	tracker.Metrics = shared.NewMetrics()
+	tracker.Trace.Metrics = tracker.Metrics
+	if *metricsAddr != "" {
+		if err := shared.ServeMetrics(*metricsAddr, tracker.Metrics); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *duration > 0 || *maxMessages > 0 {
+		go stopWhenDone(ctx, func() {
+			stopped.Store(true)
+			cancel()
+		}, *duration, *maxMessages, tracker.Metrics)
+	}
+	if *progressInterval > 0 {
+		go reportProgress(ctx, *progressInterval, tracker.Metrics)
+	}
+
+	// sem holds one token per active connection when -max-conns is set. A
+	// token is released once that IP's stream has closed, letting the next
+	// waiting IP connect. Tokens are taken here in ipfile order, so that
+	// -state-file advances through the IPs in order.
+	var sem chan struct{}
+	if *maxConns > 0 {
+		sem = make(chan struct{}, *maxConns)
+	}
+
+launch:
+	for k, ip := range ips {
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				break launch
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
 		wg.Add(1)
-		go func(ip string) {
+		go func(index int, ip string) {
 			defer wg.Done()
-			if err := receiveMessages(ctx, ip, *outputData != "", dataCh, *outputTrace != "", traceCh); err != nil {
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			ipDataCh := dataCh
+			if *outputDir != "" {
+				ch := make(chan string, 100)
+				done := make(chan bool)
+				name := filepath.Join(*outputDir, endpointFileName(ip))
+				go shared.WriteToFileWithOptions(ctx, ch, done, name, header, writerOpts)
+				defer func() {
+					close(ch)
+					<-done
+				}()
+				ipDataCh = ch
+			}
+			if err := receiveWithRetry(ctx, ip, writeData, ipDataCh, writeTrace, traceCh, tracker); err != nil {
 				errCh <- err
 				cancel()
+				return
+			}
+			// The stream ended on its own or was served until a deliberate
+			// stop; either way this IP is done with.
+			if ctx.Err() == nil || stopped.Load() {
+				prog.finish(index)
 			}
-		}(ip)
+		}(indices[k], ip)
 	}
 
 	wg.Wait()
 	close(errCh)
 	close(dataCh)
-	close(traceCh)
+	if traceCh != dataCh {
+		close(traceCh)
+	}
 	if dataDone != nil {
 		<-dataDone
 	}
@@ -100,75 +321,341 @@ func main() {
 		<-traceDone
 	}
 
+	if tracker.Trace.Shards != nil {
+		tracker.Trace.Shards.Print()
+	}
+	tracker.Sequences.Print()
+	tracker.Metrics.PrintTraceTypes()
+	if n := tracker.Metrics.DecodeErrors(); n > 0 {
+		shared.Log.Warnf("Decode errors: %d messages or trace events could not be decoded and were dropped", n)
+	} else {
+		shared.Log.Infof("Decode errors: 0")
+	}
+	if checked, failed := tracker.Metrics.IntegrityFailures(); failed > 0 {
+		shared.Log.Warnf("Integrity failures: %d of %d checksummed messages did not match their embedded sha256", failed, checked)
+	} else {
+		shared.Log.Infof("Integrity failures: 0 of %d checksummed messages", checked)
+	}
+
 	hasErrors := false
 	for err := range errCh {
 		hasErrors = true
-		log.Printf("subscribe worker error: %v", err)
+		shared.Log.Errorf("subscribe worker error: %v", err)
 	}
 	if hasErrors {
 		os.Exit(1)
 	}
 }
 
-func receiveMessages(ctx context.Context, ip string, writeData bool, dataCh chan<- string,
-	writeTrace bool, traceCh chan<- string) error {
+// reportProgress logs, every interval until ctx is canceled, how many
+// messages m has recorded in total and the rate since the previous report.
+func reportProgress(ctx context.Context, interval time.Duration, m *shared.Metrics) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last, lastAt := m.MessagesReceived(), time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			total := m.MessagesReceived()
+			rate := float64(total-last) / now.Sub(lastAt).Seconds()
+			shared.Log.Infof("Progress: %d messages received, %.1f msg/s", total, rate)
+			last, lastAt = total, now
+		}
+	}
+}
+
+// stopWhenDone calls stop once d has elapsed or m has recorded max received
+// messages, whichever comes first. A zero limit is ignored.
+func stopWhenDone(ctx context.Context, stop func(), d time.Duration, max uint64, m *shared.Metrics) {
+	var deadline <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	var tick <-chan time.Time
+	if max > 0 {
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			shared.Log.Infof("Reached -duration %v, shutting down…", d)
+			stop()
+			return
+		case <-tick:
+			if n := m.MessagesReceived(); n >= max {
+				shared.Log.Infof("Received %d messages (-max-messages %d), shutting down…", n, max)
+				stop()
+				return
+			}
+		}
+	}
+}
+
+const dataHeader = "receiver\tsender\tsize\tsha256(msg)"
+
+// endpointFileName turns a host:port endpoint into a -output-dir file name,
+// e.g. 10.0.0.1:33212 becomes 10.0.0.1_33212.tsv.
+func endpointFileName(ip string) string {
+	name := strings.NewReplacer("[", "", "]", "", ":", "_", "/", "_").Replace(ip)
+	return name + ".tsv"
+}
+
+// unsubscribeGrace is how long a stream may take to close after the
+// shutdown unsubscribe before it is cancelled.
+const unsubscribeGrace = 2 * time.Second
+
+// unsubscribe sends CommandUnSubscribeToTopic and half-closes stream so the
+// sidecar can release the subscription. Errors are only logged, since the
+// stream is being torn down anyway.
+func unsubscribe(ip string, stream protobuf.CommandStream_ListenCommandsClient) {
+	unsubReq := &protobuf.Request{
+		Command: int32(shared.CommandUnSubscribeToTopic),
+		Topic:   *topic,
+	}
+	if err := stream.Send(unsubReq); err != nil {
+		shared.Log.Warnf("[%s] send unsubscribe: %v", ip, err)
+	} else {
+		shared.Log.Debugf("[%s] unsubscribed from topic %q", ip, *topic)
+	}
+	if err := stream.CloseSend(); err != nil {
+		shared.Log.Warnf("[%s] close send: %v", ip, err)
+	}
+}
+
+// preflightProbes caps how many preflight TCP probes run at once.
+const preflightProbes = 64
+
+// preflight TCP-dials every IP with the given timeout and splits their
+// positions in ips into reachable and unreachable lists, each in order.
+func preflight(ctx context.Context, ips []string, timeout time.Duration) (reachable, unreachable []int) {
+	ok := make([]bool, len(ips))
+	sem := make(chan struct{}, preflightProbes)
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, ip string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			d := net.Dialer{Timeout: timeout}
+			conn, err := d.DialContext(ctx, "tcp", ip)
+			if err != nil {
+				shared.Log.Debugf("[%s] preflight failed: %v", ip, err)
+				return
+			}
+			conn.Close()
+			ok[i] = true
+		}(i, ip)
+	}
+	wg.Wait()
+
+	for i := range ips {
+		if ok[i] {
+			reachable = append(reachable, i)
+		} else {
+			unreachable = append(unreachable, i)
+		}
+	}
+	return reachable, unreachable
+}
+
+// resumeState is the content of -state-file.
+type resumeState struct {
+	IPFile string `json:"ipfile"`
+	// NextIndex is the ipfile index after the last fully-processed IP: every
+	// IP before it, from the start index of the run that wrote it, is done.
+	NextIndex int `json:"nextIndex"`
+}
+
+// readResumeIndex returns the NextIndex recorded in path, or false if path
+// does not exist yet. It fails if the state was written for another ipfile.
+func readResumeIndex(path, ipfile string) (int, bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	var st resumeState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return 0, false, fmt.Errorf("%s: %w", path, err)
+	}
+	if abs, _ := filepath.Abs(ipfile); st.IPFile != abs {
+		return 0, false, fmt.Errorf("%s was written for -ipfile %s, not %s", path, st.IPFile, ipfile)
+	}
+	return st.NextIndex, true, nil
+}
+
+// progress records in its state file the first index not yet fully
+// processed. IPs finish in any order, so the recorded index only moves past
+// an IP once every IP before it has finished too. A nil *progress records
+// nothing.
+type progress struct {
+	mu    sync.Mutex
+	path  string
+	state resumeState
+	done  map[int]bool
+}
+
+// newProgress writes start as the initial NextIndex to path.
+func newProgress(path, ipfile string, start int) (*progress, error) {
+	abs, err := filepath.Abs(ipfile)
+	if err != nil {
+		return nil, err
+	}
+	p := &progress{path: path, state: resumeState{IPFile: abs, NextIndex: start}, done: make(map[int]bool)}
+	return p, p.save()
+}
+
+// finish marks index as fully processed and rewrites the state file if that
+// advances NextIndex.
+func (p *progress) finish(index int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done[index] = true
+	if !p.done[p.state.NextIndex] {
+		return
+	}
+	for p.done[p.state.NextIndex] {
+		delete(p.done, p.state.NextIndex)
+		p.state.NextIndex++
+	}
+	if err := p.save(); err != nil {
+		shared.Log.Warnf("write -state-file: %v", err)
+	}
+}
+
+// save writes the state through a temporary file, so an interrupted write
+// never leaves a truncated state file behind.
+func (p *progress) save() error {
+	data, err := json.Marshal(p.state)
+	if err != nil {
+		return err
+	}
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
+
+// receiveWithRetry runs receiveMessages, reconnecting with a wider keepalive
+// interval whenever the sidecar rejects the pings with too_many_pings. Any
+// other error ends the run for this IP.
+func receiveWithRetry(ctx context.Context, ip string, writeData bool, dataCh chan<- string,
+	writeTrace bool, traceCh chan<- string, tracker *shared.Tracker) error {
+
+	interval := *keepaliveInterval
+	for {
+		err := receiveMessages(ctx, ip, interval, writeData, dataCh, writeTrace, traceCh, tracker)
+		if !shared.IsTooManyPings(err) || ctx.Err() != nil {
+			return err
+		}
+		next, ok := shared.WidenKeepalive(ip, interval)
+		if !ok {
+			return err
+		}
+		interval = next
+	}
+}
+
+func receiveMessages(ctx context.Context, ip string, keepaliveInterval time.Duration, writeData bool, dataCh chan<- string,
+	writeTrace bool, traceCh chan<- string, tracker *shared.Tracker) error {
 
 	select {
 	case <-ctx.Done():
-		log.Printf("[%s] context canceled, stopping", ip)
+		shared.Log.Infof("[%s] context canceled, stopping", ip)
 		return nil
 	default:
 	}
 
-	conn, err := grpc.NewClient(ip,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithDefaultCallOptions(
-			grpc.MaxCallRecvMsgSize(math.MaxInt),
-			grpc.MaxCallSendMsgSize(math.MaxInt),
-		),
+	conn, client, err := shared.NewStreamClient(ctx, ip,
+		shared.WithCredentials(transportCreds),
+		shared.WithKeepalive(keepaliveInterval, *keepaliveTimeout),
+		shared.WithDialTimeout(*dialTimeout),
 	)
-
-	fmt.Printf("IP -  %v\n", ip)
 	if err != nil {
-		log.Printf("[%s] failed to connect to node: %v", ip, err)
+		if ctx.Err() != nil {
+			return nil
+		}
+		shared.Log.Errorf("[%s] %v", ip, err)
 		return fmt.Errorf("failed to connect to node %s: %w", ip, err)
 	}
 	defer conn.Close()
 
-	client := protobuf.NewCommandStreamClient(conn)
-	stream, err := client.ListenCommands(ctx)
+	// The stream outlives ctx so that an unsubscribe can still be sent on
+	// shutdown; it is cancelled once the sidecar has closed it or after
+	// unsubscribeGrace.
+	streamCtx, streamCancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer streamCancel()
+
+	stream, err := client.ListenCommands(streamCtx)
 	if err != nil {
-		log.Printf("[%s] ListenCommands failed: %v", ip, err)
+		shared.Log.Errorf("[%s] ListenCommands failed: %v", ip, err)
 		return fmt.Errorf("ListenCommands failed for %s: %w", ip, err)
 	}
 
-	println(fmt.Sprintf("Connected to node at: %s…", ip))
-	println(fmt.Sprintf("Trying to subscribe to topic %s…", *topic))
+	shared.Log.Infof("Connected to node at: %s…", ip)
+	shared.Log.Debugf("[%s] trying to subscribe to topic %s…", ip, *topic)
 	subReq := &protobuf.Request{
 		Command: int32(shared.CommandSubscribeToTopic),
 		Topic:   *topic,
 	}
 	if err := stream.Send(subReq); err != nil {
-		log.Printf("[%s] send subscribe failed: %v", ip, err)
+		shared.Log.Errorf("[%s] send subscribe failed: %v", ip, err)
 		return fmt.Errorf("send subscribe failed for %s: %w", ip, err)
 	}
-	fmt.Printf("Subscribed to topic %q, waiting for messages…\n", *topic)
+	shared.Log.Infof("[%s] subscribed to topic %q, waiting for messages…", ip, *topic)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+			return
+		}
+		unsubscribe(ip, stream)
+		select {
+		case <-time.After(unsubscribeGrace):
+			streamCancel()
+		case <-stop:
+		}
+	}()
 
 	var receivedCount int32
+	if tracker.Duplicates != nil {
+		defer func() {
+			shared.Log.Infof("[%s] suppressed %d duplicate messages", ip, tracker.Duplicates.Get(ip))
+		}()
+	}
 	for {
 		resp, err := stream.Recv()
-		if err == io.EOF {
-			log.Printf("[%s] stream closed. Total messages received: %d", ip, atomic.LoadInt32(&receivedCount))
-			return nil
-		}
 		if err != nil {
-			if ctx.Err() != nil {
-				log.Printf("[%s] context canceled. Total messages received: %d", ip, atomic.LoadInt32(&receivedCount))
+			outcome := shared.ClassifyRecvError(err)
+			switch {
+			case outcome == shared.RecvClosed:
+				shared.Log.Infof("[%s] stream closed. Total messages received: %d", ip, atomic.LoadInt32(&receivedCount))
+				return nil
+			case outcome == shared.RecvCanceled || ctx.Err() != nil:
+				shared.Log.Infof("[%s] context canceled. Total messages received: %d", ip, atomic.LoadInt32(&receivedCount))
 				return nil
 			}
-			return fmt.Errorf("[%s] recv error: %w", ip, err)
+			return fmt.Errorf("[%s] recv error (%s): %w", ip, outcome, err)
 		}
 
-		shared.HandleResponseWithTracking(ip, resp, &receivedCount, writeData, dataCh, writeTrace, traceCh)
+		shared.HandleResponseWithTracking(ip, resp, &receivedCount, writeData, dataCh, writeTrace, traceCh, tracker)
 	}
 }
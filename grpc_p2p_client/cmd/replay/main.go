@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	protobuf "p2p_client/grpc"
+	"p2p_client/shared"
+
+	"google.golang.org/grpc"
+)
+
+var (
+	input       = flag.String("input", "", "publish output file to replay (sender\\tsize\\tsha256(msg)\\ttimestamp\\ttopic, optionally without the topic or both trailing columns)")
+	addr        = flag.String("addr", "localhost:33212", "sidecar gRPC address to publish to")
+	topic       = flag.String("topic", "", "topic to publish to (default: each row's topic column)")
+	sleep       = flag.Duration("sleep", 0, "delay between publishes when -input has no timestamp column")
+	output      = flag.String("output", "", "file to write the replayed message hashes, in the multi-publish -output format")
+	dialTimeout = flag.Duration("dial-timeout", 10*time.Second, "give up if the node is not connected within this long (0 waits for the OS TCP timeout)")
+
+	logLevel = flag.String("log-level", "info", "minimum log level: debug | info | warn | error")
+	verbose  = flag.Bool("v", false, "log every message sent (same as -log-level=debug)")
+
+	tlsFlags = shared.RegisterTLSFlags(flag.CommandLine)
+)
+
+// outputHeader matches the multi-publish -output header, so replayed runs can
+// be checked with p2p-verify like the original.
+const outputHeader = "sender\tsize\t" + shared.HashColumn + "\ttimestamp\ttopic"
+
+// row is one publish to replay. At is the offset from the first row, or zero
+// for every row if the file has no timestamps.
+type row struct {
+	At     time.Duration
+	Sender string
+	Topic  string
+	Size   int
+}
+
+func main() {
+	flag.Parse()
+	if err := shared.ConfigureLogging(*logLevel, *verbose); err != nil {
+		log.Fatal(err)
+	}
+	if *input == "" {
+		log.Fatal("-input is required")
+	}
+	endpoint, err := shared.NormalizeEndpoint(*addr, "33212")
+	if err != nil {
+		log.Fatalf("-addr: %v", err)
+	}
+	creds, err := tlsFlags.DialOption()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rows, timed, err := loadRows(*input)
+	if err != nil {
+		log.Fatalf("-input: %v", err)
+	}
+	if len(rows) == 0 {
+		log.Fatalf("-input: %s has no rows", *input)
+	}
+	for i := range rows {
+		if *topic != "" {
+			rows[i].Topic = *topic
+		}
+		if rows[i].Topic == "" {
+			log.Fatalf("-input: %s has no topic column; set -topic", *input)
+		}
+	}
+	if timed {
+		shared.Log.Infof("Replaying %d message(s) over %v", len(rows), rows[len(rows)-1].At.Round(time.Millisecond))
+	} else {
+		shared.Log.Infof("Replaying %d message(s) with -sleep %v (no timestamp column)", len(rows), *sleep)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		shared.Log.Infof("Shutting down gracefully…")
+		cancel()
+	}()
+
+	dataCh := make(chan string, 100)
+	var done chan bool
+	if *output != "" {
+		done = make(chan bool)
+		go shared.WriteToFile(ctx, dataCh, done, *output, outputHeader)
+	}
+
+	sent, err := replay(ctx, endpoint, creds, rows, timed, *output != "", dataCh)
+	close(dataCh)
+	if done != nil {
+		<-done
+	}
+	shared.Log.Infof("Replayed %d of %d message(s)", sent, len(rows))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadRows reads the rows of a publish output file. Columns are found by
+// header name; header-less files are taken to have the multi-publish layout,
+// with or without the trailing timestamp and topic columns. Timed rows are sorted by
+// timestamp, since every IP's rows are written as they complete.
+func loadRows(filename string) ([]row, bool, error) {
+	header, records, err := shared.ReadTSVFile(filename)
+	if err != nil {
+		return nil, false, err
+	}
+
+	tsCol, senderCol, topicCol, sizeCol := -1, -1, -1, -1
+	for i, name := range header {
+		switch name {
+		case "timestamp":
+			tsCol = i
+		case "sender":
+			senderCol = i
+		case "topic":
+			topicCol = i
+		case "size":
+			sizeCol = i
+		}
+	}
+	if header == nil && len(records) > 0 {
+		switch len(records[0]) {
+		case 5:
+			senderCol, sizeCol, tsCol, topicCol = 0, 1, 3, 4
+		case 4:
+			senderCol, sizeCol, tsCol = 0, 1, 3
+		case 3:
+			senderCol, sizeCol = 0, 1
+		}
+	}
+	if sizeCol < 0 {
+		return nil, false, fmt.Errorf("%s: no size column", filename)
+	}
+
+	type timedRow struct {
+		ts int64
+		row
+	}
+	out := make([]timedRow, 0, len(records))
+	for i, rec := range records {
+		if len(rec) <= max(tsCol, senderCol, topicCol, sizeCol) {
+			return nil, false, fmt.Errorf("%s: row %d has %d columns", filename, i+1, len(rec))
+		}
+		size, err := strconv.Atoi(rec[sizeCol])
+		if err != nil || size < 1 {
+			return nil, false, fmt.Errorf("%s: row %d: bad size %q", filename, i+1, rec[sizeCol])
+		}
+		r := timedRow{row: row{Sender: "replay", Size: size}}
+		if senderCol >= 0 && rec[senderCol] != "" {
+			r.Sender = rec[senderCol]
+		}
+		if topicCol >= 0 {
+			r.Topic = rec[topicCol]
+		}
+		if tsCol >= 0 {
+			if r.ts, err = strconv.ParseInt(rec[tsCol], 10, 64); err != nil {
+				return nil, false, fmt.Errorf("%s: row %d: bad timestamp %q", filename, i+1, rec[tsCol])
+			}
+		}
+		out = append(out, r)
+	}
+
+	timed := tsCol >= 0
+	if timed {
+		sort.SliceStable(out, func(i, j int) bool { return out[i].ts < out[j].ts })
+	}
+	rows := make([]row, len(out))
+	for i, r := range out {
+		if timed {
+			r.At = time.Duration(r.ts - out[0].ts)
+		}
+		rows[i] = r.row
+	}
+	return rows, timed, nil
+}
+
+// replay publishes one fresh message per row on a single stream and returns
+// how many were sent. Timed rows are sent at their offset from the start of
+// the replay; untimed rows are separated by -sleep.
+func replay(ctx context.Context, endpoint string, creds grpc.DialOption, rows []row, timed, write bool, dataCh chan<- string) (int, error) {
+	shared.Log.Infof("Connecting to node at: %s…", endpoint)
+	conn, client, err := shared.NewStreamClient(ctx, endpoint,
+		shared.WithCredentials(creds), shared.WithDialTimeout(*dialTimeout))
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer conn.Close()
+
+	// As in multi-publish, the stream outlives ctx so that a Send in progress
+	// on SIGINT completes and is still written to the output.
+	stream, err := client.ListenCommands(context.WithoutCancel(ctx))
+	if err != nil {
+		return 0, fmt.Errorf("ListenCommands: %w", err)
+	}
+	defer func() {
+		_ = stream.CloseSend()
+	}()
+
+	// seqs holds the next sequence number for each sender, so every sender's
+	// messages are numbered from 0 as multi-publish numbers them.
+	seqs := make(map[string]uint64)
+	start := time.Now()
+	for i, r := range rows {
+		wait := *sleep
+		if timed {
+			wait = time.Until(start.Add(r.At))
+		}
+		if (i > 0 || timed) && !shared.Sleep(ctx, wait) {
+			return i, nil
+		}
+
+		data, err := replayPayload(seqs[r.Sender], r.Sender, r.Size)
+		if err != nil {
+			return i, err
+		}
+		sentAt := time.Now()
+		if err := stream.Send(&protobuf.Request{
+			Command: int32(shared.CommandPublishData),
+			Topic:   r.Topic,
+			Data:    data,
+		}); err != nil {
+			return i, fmt.Errorf("send publish: %w", err)
+		}
+		seqs[r.Sender]++
+
+		hash := sha256.Sum256(data)
+		if write {
+			dataCh <- fmt.Sprintf("%s\t%d\t%s\t%d\t%s", r.Sender, len(data), hex.EncodeToString(hash[:]), sentAt.UnixNano(), r.Topic)
+		}
+		shared.Log.Debugf("published %d bytes to %q (%s, offset %v)", len(data), r.Topic, r.Sender, sentAt.Sub(start).Round(time.Millisecond))
+	}
+	return len(rows), nil
+}
+
+// replayPayload builds a size-byte message with a fresh random hex body. It
+// carries the usual payload header for publisher unless size is too small
+// to hold it.
+func replayPayload(seq uint64, publisher string, size int) ([]byte, error) {
+	h := shared.PayloadHeader{Seq: seq, Publisher: publisher}
+	// The header length does not depend on the body, so an empty body gives it.
+	headerLen := len(shared.EncodePayload(h, nil))
+	if headerLen >= size {
+		headerLen = 0
+	}
+	n := size - headerLen
+	randomBytes := make([]byte, (n+1)/2)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate random bytes: %v", err)
+	}
+	body := []byte(hex.EncodeToString(randomBytes)[:n])
+	if headerLen == 0 {
+		return body, nil
+	}
+	return shared.EncodePayload(h, body), nil
+}
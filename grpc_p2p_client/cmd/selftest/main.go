@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	protobuf "p2p_client/grpc"
+	"p2p_client/shared"
+
+	"google.golang.org/grpc"
+)
+
+var (
+	addr        = flag.String("addr", "localhost:33212", "sidecar gRPC address")
+	topic       = flag.String("topic", "selftest", "topic to subscribe and publish to")
+	count       = flag.Int("count", 10, "number of messages to publish")
+	sleep       = flag.Duration("sleep", 0, "optional delay between publishes (e.g., 1s, 500ms)")
+	settle      = flag.Duration("settle", time.Second, "wait this long after subscribing before publishing")
+	timeout     = flag.Duration("timeout", 10*time.Second, "how long to wait after the last publish for every message to come back")
+	dialTimeout = flag.Duration("dial-timeout", 10*time.Second, "give up if the node is not connected within this long (0 waits for the OS TCP timeout)")
+
+	logLevel = flag.String("log-level", "info", "minimum log level: debug | info | warn | error")
+	verbose  = flag.Bool("v", false, "log every message sent or received (same as -log-level=debug)")
+
+	tlsFlags = shared.RegisterTLSFlags(flag.CommandLine)
+)
+
+func main() {
+	flag.Parse()
+	if err := shared.ConfigureLogging(*logLevel, *verbose); err != nil {
+		log.Fatal(err)
+	}
+	if *topic == "" {
+		log.Fatal("-topic is required")
+	}
+	if *count < 1 {
+		log.Fatal("-count must be at least 1")
+	}
+	endpoint, err := shared.NormalizeEndpoint(*addr, "33212")
+	if err != nil {
+		log.Fatalf("-addr: %v", err)
+	}
+	creds, err := tlsFlags.DialOption()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		shared.Log.Infof("shutting down…")
+		cancel()
+	}()
+
+	lost, err := run(ctx, endpoint, creds)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if lost > 0 {
+		fmt.Printf("FAIL: %d of %d messages not received back from %s\n", lost, *count, endpoint)
+		os.Exit(1)
+	}
+	fmt.Printf("PASS: all %d messages received back from %s\n", *count, endpoint)
+}
+
+// run subscribes to -topic, publishes -count messages on the same stream and
+// returns how many of them were not received back within -timeout.
+func run(ctx context.Context, endpoint string, creds grpc.DialOption) (int, error) {
+	shared.Log.Infof("Connecting to node at: %s…", endpoint)
+	conn, client, err := shared.NewStreamClient(ctx, endpoint,
+		shared.WithCredentials(creds), shared.WithDialTimeout(*dialTimeout))
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	stream, err := client.ListenCommands(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("ListenCommands: %w", err)
+	}
+
+	subReq := &protobuf.Request{
+		Command: int32(shared.CommandSubscribeToTopic),
+		Topic:   *topic,
+	}
+	if err := stream.Send(subReq); err != nil {
+		return 0, fmt.Errorf("send subscribe: %w", err)
+	}
+	shared.Log.Infof("Subscribed to topic %q", *topic)
+
+	// The receive side goes through the same handler as multi-subscribe; the
+	// hash is the last column of each data line it emits.
+	dataCh := make(chan string, *count+64)
+	recvErr := make(chan error, 1)
+	go func() {
+		var received int32
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			shared.HandleResponseWithTracking(endpoint, resp, &received, true, dataCh, false, nil, nil)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-time.After(*settle):
+	}
+
+	pending := make(map[string]bool, *count)
+	for i := 0; i < *count; i++ {
+		data, err := newPayload(i)
+		if err != nil {
+			return 0, err
+		}
+		hash := sha256.Sum256(data)
+		pending[hex.EncodeToString(hash[:])] = true
+
+		pubReq := &protobuf.Request{
+			Command: int32(shared.CommandPublishData),
+			Topic:   *topic,
+			Data:    data,
+		}
+		if err := stream.Send(pubReq); err != nil {
+			return 0, fmt.Errorf("send publish: %w", err)
+		}
+		shared.Log.Debugf("Published %q to %q", string(data), *topic)
+		if *sleep > 0 && i < *count-1 && !shared.Sleep(ctx, *sleep) {
+			return len(pending), nil
+		}
+	}
+	shared.Log.Infof("Published %d message(s), waiting up to %v for them to come back", *count, *timeout)
+
+	deadline := time.After(*timeout)
+	for len(pending) > 0 {
+		select {
+		case line := <-dataCh:
+			hash := line[strings.LastIndexByte(line, '\t')+1:]
+			if pending[hash] {
+				delete(pending, hash)
+				shared.Log.Debugf("Received %s", hash)
+			} else {
+				shared.Log.Debugf("Ignoring message %s not published by this test", hash)
+			}
+		case err := <-recvErr:
+			if err == io.EOF {
+				err = fmt.Errorf("stream closed by sidecar")
+			}
+			shared.Log.Errorf("recv: %v", err)
+			return len(pending), nil
+		case <-deadline:
+			for hash := range pending {
+				shared.Log.Debugf("Not received: %s", hash)
+			}
+			return len(pending), nil
+		case <-ctx.Done():
+			return len(pending), nil
+		}
+	}
+	return 0, nil
+}
+
+// newPayload builds the i-th test message in the same format as the random
+// payloads of p2p-client publish mode.
+func newPayload(i int) ([]byte, error) {
+	randomSuffix, err := shared.RandomSuffix()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("[%d %d] %d - %s XXX", time.Now().UnixNano(), len(randomSuffix), i+1, randomSuffix)), nil
+}
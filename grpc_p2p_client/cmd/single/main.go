@@ -2,15 +2,13 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"math"
 	"os"
 	"os/signal"
+	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -19,100 +17,308 @@ import (
 	"p2p_client/shared"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 var (
 	addr    = flag.String("addr", "localhost:33212", "sidecar gRPC address")
-	mode    = flag.String("mode", "subscribe", "mode: subscribe | publish")
+	mode    = flag.String("mode", "subscribe", "mode: subscribe | publish | unsubscribe")
 	topic   = flag.String("topic", "", "topic name")
+	topics  = flag.String("topics", "", "comma-separated topic names to subscribe to over one stream (for subscribe)")
 	message = flag.String("msg", "", "message data (for publish)")
+	file    = flag.String("file", "", "file whose contents are published as the message (for publish)")
 	count   = flag.Int("count", 1, "number of messages to publish (for publish mode)")
 	sleep   = flag.Duration("sleep", 0, "optional delay between publishes (e.g., 1s, 500ms)")
+
+	ensureSubscribed = flag.Bool("ensure-subscribed", false, "before publishing, subscribe to -topic and wait for the sidecar to confirm (for publish)")
+	subscribeTimeout = flag.Duration("subscribe-timeout", 10*time.Second, "how long -ensure-subscribed waits for confirmation")
+
+	waitAck    = flag.Bool("wait-ack", false, "after each publish, wait for one response from the sidecar and report it (for publish)")
+	ackTimeout = flag.Duration("ack-timeout", 5*time.Second, "how long -wait-ack waits for a response")
+
+	maxBackoff = flag.Duration("max-backoff", 30*time.Second, "maximum delay between reconnect attempts (for subscribe)")
+
+	keepaliveInterval = flag.Duration("keepalive-interval", 2*time.Minute, "interval between gRPC keepalive pings")
+	keepaliveTimeout  = flag.Duration("keepalive-timeout", 20*time.Second, "time to wait for a keepalive ping ack before closing the connection")
+	dialTimeout       = flag.Duration("dial-timeout", 10*time.Second, "give up on a node that is not connected within this long (0 waits for the OS TCP timeout)")
+
+	logLevel = flag.String("log-level", "info", "minimum log level: debug | info | warn | error")
+	verbose  = flag.Bool("v", false, "log every message sent or received (same as -log-level=debug)")
+
+	tlsFlags = shared.RegisterTLSFlags(flag.CommandLine)
+
+	// transportCreds is built from tlsFlags once flags are parsed.
+	transportCreds grpc.DialOption
 )
 
+const initialBackoff = 500 * time.Millisecond
+
+// healthyStreamAge is how long a subscribe stream must stay up, if nothing
+// was received on it, before a failure resets the reconnect backoff.
+const healthyStreamAge = 10 * time.Second
+
 func main() {
 	flag.Parse()
-	if *topic == "" {
+	if err := shared.ConfigureLogging(*logLevel, *verbose); err != nil {
+		log.Fatal(err)
+	}
+	creds, err := tlsFlags.DialOption()
+	if err != nil {
+		log.Fatal(err)
+	}
+	transportCreds = creds
+	topicList := splitTopics(*topics)
+	if *topic == "" && (*mode != "subscribe" || len(topicList) == 0) {
 		log.Fatal("-topic is required")
 	}
-
-	println(fmt.Sprintf("Connecting to node at: %s…", *addr))
-	conn, err := grpc.NewClient(*addr,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithDefaultCallOptions(
-			grpc.MaxCallRecvMsgSize(math.MaxInt),
-			grpc.MaxCallSendMsgSize(math.MaxInt),
-		),
-	)
+	endpoint, err := shared.NormalizeEndpoint(*addr, "33212")
 	if err != nil {
-		log.Fatalf("failed to connect to node %v", err)
+		log.Fatalf("-addr: %v", err)
 	}
-	defer conn.Close()
+	*addr = endpoint
 
-	client := protobuf.NewCommandStreamClient(conn)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	stream, err := client.ListenCommands(ctx)
-	if err != nil {
-		log.Fatalf("ListenCommands: %v", err)
-	}
-
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		fmt.Println("\nshutting down…")
+		shared.Log.Infof("shutting down…")
 		cancel()
 	}()
 
+	if *mode == "subscribe" {
+		runSubscriber(ctx, *addr, *topic, topicList, *maxBackoff)
+		return
+	}
+
+	// cancelStream lets -ensure-subscribed abort a receive that times out.
+	streamCtx, cancelStream := context.WithCancel(ctx)
+	defer cancelStream()
+	conn, stream, err := connect(streamCtx, *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
 	switch *mode {
-	case "subscribe":
-		subscribe(ctx, stream, *topic)
 	case "publish":
-		publish(ctx, stream, *topic, *message, *count, *sleep)
+		payload, err := loadPayload(*message, *file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *ensureSubscribed {
+			resp, err := shared.EnsureSubscribed(stream, cancelStream, *topic, *subscribeTimeout)
+			if err != nil {
+				log.Fatal(err)
+			}
+			shared.Log.Infof("Subscription to %q looks active: first response is %s (%d bytes) %s",
+				*topic, resp.GetCommand(), len(resp.GetData()), shared.HeadHex(resp.GetData(), 32))
+		}
+		var acks <-chan ackResult
+		if *waitAck {
+			acks = readResponses(stream)
+		}
+		publish(ctx, stream, *topic, payload, *file, *count, *sleep, acks)
+	case "unsubscribe":
+		unsubscribe(stream, *topic)
 	default:
 		log.Fatalf("unknown mode %q", *mode)
 	}
 }
 
-func subscribe(ctx context.Context, stream protobuf.CommandStream_ListenCommandsClient, topic string) {
-	println(fmt.Sprintf("Trying to subscribe to topic %s…", topic))
-	subReq := &protobuf.Request{
-		Command: int32(shared.CommandSubscribeToTopic),
-		Topic:   topic,
+func connect(ctx context.Context, addr string) (*grpc.ClientConn, protobuf.CommandStream_ListenCommandsClient, error) {
+	shared.Log.Infof("Connecting to node at: %s…", addr)
+	conn, client, err := shared.NewStreamClient(ctx, addr,
+		shared.WithCredentials(transportCreds),
+		shared.WithKeepalive(*keepaliveInterval, *keepaliveTimeout),
+		shared.WithDialTimeout(*dialTimeout),
+	)
+	if err != nil {
+		return nil, nil, err
 	}
-	if err := stream.Send(subReq); err != nil {
-		log.Fatalf("send subscribe: %v", err)
+
+	stream, err := client.ListenCommands(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("ListenCommands: %w", err)
 	}
-	fmt.Printf("Subscribed to topic %q, waiting for messages…\n", topic)
+	return conn, stream, nil
+}
 
+// runSubscriber connects, subscribes and receives until ctx is canceled or
+// the server closes the stream. Any other stream error triggers a reconnect
+// with exponential backoff capped at maxBackoff; counters are kept across
+// reconnects.
+func runSubscriber(ctx context.Context, addr, topic string, topicList []string, maxBackoff time.Duration) {
 	var receivedCount int32
+	latency := shared.NewLatencyStats()
+	var counts *shared.KeyCounter
+	if len(topicList) > 0 {
+		counts = shared.NewKeyCounter()
+	}
+	defer func() {
+		shared.Log.Infof("Total messages received: %d", atomic.LoadInt32(&receivedCount))
+		latency.Print()
+		if counts != nil {
+			fmt.Println("Messages received per topic:")
+			counts.Print()
+		}
+	}()
+
+	backoff := initialBackoff
 	for {
-		resp, err := stream.Recv()
-		if err == io.EOF {
-			log.Printf("Stream closed. Total messages received: %d", atomic.LoadInt32(&receivedCount))
+		healthy, err := subscribeOnce(ctx, addr, topic, topicList, &receivedCount, counts, latency)
+		if err == nil || ctx.Err() != nil {
 			return
 		}
-		if err != nil {
-			if ctx.Err() != nil {
-				log.Printf("Context canceled. Total messages received: %d", atomic.LoadInt32(&receivedCount))
-				return
+		if healthy {
+			backoff = initialBackoff
+		}
+		switch shared.ClassifyRecvError(err) {
+		case shared.RecvFatal:
+			shared.Log.Errorf("stream error: %v; not retrying", err)
+			return
+		case shared.RecvBackoff:
+			if shared.IsTooManyPings(err) {
+				next, ok := shared.WidenKeepalive(addr, *keepaliveInterval)
+				if !ok {
+					return
+				}
+				*keepaliveInterval = next
+			} else {
+				// The sidecar is shedding load; don't come back quickly.
+				backoff = maxBackoff
 			}
-			log.Printf("recv error: %v", err)
+		}
+		shared.Log.Warnf("stream error: %v; reconnecting in %v", err, backoff)
+		select {
+		case <-ctx.Done():
 			return
+		case <-time.After(backoff):
 		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// subscribeOnce runs a single connect+subscribe+receive cycle. It returns a nil
+// error when the stream ends normally and reports whether the stream was
+// healthy: it received at least one response or stayed up for
+// healthyStreamAge. A stream the sidecar fails right after subscribing is not.
+func subscribeOnce(ctx context.Context, addr, topic string, topicList []string,
+	receivedCount *int32, counts *shared.KeyCounter, latency *shared.LatencyStats) (bool, error) {
+
+	conn, stream, err := connect(ctx, addr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
 
-		shared.HandleResponse(resp, &receivedCount)
+	if len(topicList) > 0 {
+		err = subscribeTopics(stream, topicList)
+	} else {
+		err = subscribe(stream, topic)
 	}
+	if err != nil {
+		return false, err
+	}
+
+	start := time.Now()
+	received := false
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			healthy := received || time.Since(start) >= healthyStreamAge
+			outcome := shared.ClassifyRecvError(err)
+			switch {
+			case outcome == shared.RecvClosed:
+				shared.Log.Infof("Stream closed. Total messages received: %d", atomic.LoadInt32(receivedCount))
+				return healthy, nil
+			case outcome == shared.RecvCanceled || ctx.Err() != nil:
+				shared.Log.Infof("Context canceled. Total messages received: %d", atomic.LoadInt32(receivedCount))
+				return healthy, nil
+			}
+			return healthy, fmt.Errorf("recv error (%s): %w", outcome, err)
+		}
+		received = true
+
+		shared.HandleResponse(resp, receivedCount, counts, latency)
+	}
+}
+
+func subscribe(stream protobuf.CommandStream_ListenCommandsClient, topic string) error {
+	shared.Log.Infof("Trying to subscribe to topic %s…", topic)
+	subReq := &protobuf.Request{
+		Command: int32(shared.CommandSubscribeToTopic),
+		Topic:   topic,
+	}
+	if err := stream.Send(subReq); err != nil {
+		return fmt.Errorf("send subscribe: %w", err)
+	}
+	shared.Log.Infof("Subscribed to topic %q, waiting for messages…", topic)
+	return nil
+}
+
+// subscribeTopics subscribes to every topic on the same stream, sending one
+// subscribe request per topic; the sidecar has no multi-topic command.
+func subscribeTopics(stream protobuf.CommandStream_ListenCommandsClient, topics []string) error {
+	for _, t := range topics {
+		if err := subscribe(stream, t); err != nil {
+			return fmt.Errorf("topic %q: %w", t, err)
+		}
+	}
+	return nil
+}
+
+// loadPayload returns the publish payload from -msg or, if set, the contents of -file.
+// A nil payload means random messages should be generated.
+func loadPayload(msg, path string) ([]byte, error) {
+	if path == "" {
+		if msg == "" {
+			return nil, nil
+		}
+		return []byte(msg), nil
+	}
+	if msg != "" {
+		return nil, fmt.Errorf("-msg and -file are mutually exclusive")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read -file: %w", err)
+	}
+	return data, nil
+}
+
+func splitTopics(s string) []string {
+	var out []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func unsubscribe(stream protobuf.CommandStream_ListenCommandsClient, topic string) {
+	shared.Log.Infof("Trying to unsubscribe from topic %s…", topic)
+	unsubReq := &protobuf.Request{
+		Command: int32(shared.CommandUnSubscribeToTopic),
+		Topic:   topic,
+	}
+	if err := stream.Send(unsubReq); err != nil {
+		log.Fatalf("send unsubscribe: %v", err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		shared.Log.Warnf("close send: %v", err)
+	}
+	shared.Log.Infof("Unsubscribed from topic %q", topic)
 }
 
 func publish(ctx context.Context, stream protobuf.CommandStream_ListenCommandsClient,
-	topic, msg string, count int, sleep time.Duration) {
+	topic string, msg []byte, source string, count int, sleep time.Duration, acks <-chan ackResult) {
 
-	if msg == "" && count == 1 {
-		log.Fatal("-msg is required in publish mode")
+	if msg == nil && count == 1 {
+		log.Fatal("-msg or -file is required in publish mode")
 	}
 
 	for i := 0; i < count; i++ {
@@ -120,16 +326,17 @@ func publish(ctx context.Context, stream protobuf.CommandStream_ListenCommandsCl
 		var data []byte
 		currentTime := time.Now().UnixNano()
 
-		if count == 1 {
+		// File payloads are republished on every iteration; inline -msg text
+		// is only used for single publishes.
+		if msg != nil && (count == 1 || source != "") {
 			prefix := fmt.Sprintf("[%d %d] ", currentTime, len(msg))
 			prefixBytes := []byte(prefix)
 			data = append(prefixBytes, msg...)
 		} else {
-			randomBytes := make([]byte, 4)
-			if _, err := rand.Read(randomBytes); err != nil {
-				log.Fatalf("failed to generate random bytes: %v", err)
+			randomSuffix, err := shared.RandomSuffix()
+			if err != nil {
+				log.Fatal(err)
 			}
-			randomSuffix := hex.EncodeToString(randomBytes)
 			data = []byte(fmt.Sprintf("[%d %d] %d - %s XXX", currentTime, len(randomSuffix), i+1, randomSuffix))
 		}
 
@@ -141,12 +348,68 @@ func publish(ctx context.Context, stream protobuf.CommandStream_ListenCommandsCl
 		if err := stream.Send(pubReq); err != nil {
 			log.Fatalf("send publish: %v", err)
 		}
+		if acks != nil {
+			if err := awaitAck(acks, *ackTimeout); err != nil {
+				log.Fatalf("publish %d to %q: %v", i+1, topic, err)
+			}
+		}
 
 		elapsed := time.Since(start)
-		fmt.Printf("Published %q to %q (took %v)\n", string(data), topic, elapsed)
+		if source != "" {
+			shared.Log.Debugf("Published %d bytes from %s to %q (took %v)", len(data), source, topic, elapsed)
+		} else {
+			shared.Log.Debugf("Published %q to %q (took %v)", string(data), topic, elapsed)
+		}
+
+		if sleep > 0 && !shared.Sleep(ctx, sleep) {
+			count = i + 1
+			break
+		}
+	}
+	shared.Log.Infof("Published %d message(s) to %q", count, topic)
+}
+
+// ackResult is one item read from the stream by readResponses.
+type ackResult struct {
+	resp *protobuf.Response
+	err  error
+}
+
+// readResponses receives from stream in the background so that each publish
+// can wait for a response with a timeout. The channel is closed after the
+// first receive error, which is delivered as the last result.
+func readResponses(stream protobuf.CommandStream_ListenCommandsClient) <-chan ackResult {
+	ch := make(chan ackResult, 16)
+	go func() {
+		defer close(ch)
+		for {
+			resp, err := stream.Recv()
+			ch <- ackResult{resp: resp, err: err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return ch
+}
 
-		if sleep > 0 {
-			time.Sleep(sleep)
+// awaitAck waits up to timeout for the sidecar's response to a publish. A
+// stream error (e.g. the topic is not assigned to this node) or a closed
+// stream is returned as an error; no response within timeout only warns,
+// since the sidecar does not acknowledge every publish.
+func awaitAck(acks <-chan ackResult, timeout time.Duration) error {
+	select {
+	case r, ok := <-acks:
+		switch {
+		case !ok || r.err == io.EOF:
+			return fmt.Errorf("stream closed by sidecar before acknowledging")
+		case r.err != nil:
+			return fmt.Errorf("rejected by sidecar: %w", r.err)
 		}
+		shared.Log.Infof("ack: %s response (%d bytes) %s", r.resp.GetCommand(), len(r.resp.GetData()), shared.HeadHex(r.resp.GetData(), 32))
+		return nil
+	case <-time.After(timeout):
+		shared.Log.Warnf("no response from sidecar within %v", timeout)
+		return nil
 	}
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"p2p_client/shared"
+)
+
+var (
+	published = flag.String("published", "", "publish output file (sender\\tsize\\tsha256(msg)\\ttimestamp\\ttopic)")
+	received  = flag.String("received", "", "subscribe data output file (receiver\\tsender\\tsize\\tsha256(msg))")
+	verbose   = flag.Bool("v", false, "list every missing and unexpected hash")
+)
+
+func main() {
+	flag.Parse()
+	if *published == "" || *received == "" {
+		log.Fatal("-published and -received are required")
+	}
+
+	pub, err := loadHashes(*published)
+	if err != nil {
+		log.Fatalf("published: %v", err)
+	}
+	recv, err := loadHashes(*received)
+	if err != nil {
+		log.Fatalf("received: %v", err)
+	}
+
+	missing := difference(pub, recv)
+	unexpected := difference(recv, pub)
+	delivered := len(pub) - len(missing)
+
+	fmt.Printf("Published unique hashes: %d\n", len(pub))
+	fmt.Printf("Received unique hashes:  %d\n", len(recv))
+	if len(pub) > 0 {
+		fmt.Printf("Delivered: %d (%.2f%%)\n", delivered, 100*float64(delivered)/float64(len(pub)))
+	}
+	fmt.Printf("Never received: %d\n", len(missing))
+	fmt.Printf("Never published: %d\n", len(unexpected))
+
+	if *verbose {
+		printHashes("Never received", missing)
+		printHashes("Never published", unexpected)
+	}
+
+	if len(missing) > 0 || len(unexpected) > 0 {
+		os.Exit(1)
+	}
+}
+
+// loadHashes returns how many rows carry each hash. The hash column is found
+// by header name, falling back to the last column for header-less files.
+// Publish files have had a header since the timestamp column was appended, so
+// a header-less file is either a subscriber file or an original three-column
+// publish file, and both end with the hash.
+func loadHashes(filename string) (map[string]int, error) {
+	header, rows, err := shared.ReadTSVFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	col := -1
+	for i, name := range header {
+		if name == shared.HashColumn {
+			col = i
+		}
+	}
+
+	hashes := make(map[string]int)
+	for i, row := range rows {
+		idx := col
+		if idx < 0 {
+			idx = len(row) - 1
+		}
+		if idx >= len(row) {
+			return nil, fmt.Errorf("row %d has %d columns, expected at least %d", i+1, len(row), idx+1)
+		}
+		hashes[row[idx]]++
+	}
+	return hashes, nil
+}
+
+func difference(a, b map[string]int) []string {
+	var out []string
+	for h := range a {
+		if _, ok := b[h]; !ok {
+			out = append(out, h)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func printHashes(title string, hashes []string) {
+	if len(hashes) == 0 {
+		return
+	}
+	fmt.Printf("\n%s:\n", title)
+	for _, h := range hashes {
+		fmt.Println(h)
+	}
+}
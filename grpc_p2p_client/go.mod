@@ -7,6 +7,7 @@ require (
 	github.com/libp2p/go-libp2p v0.39.1
 	github.com/libp2p/go-libp2p-pubsub v0.14.2
 	github.com/mr-tron/base58 v1.2.0
+	golang.org/x/time v0.14.0
 	google.golang.org/grpc v1.73.0
 	google.golang.org/protobuf v1.36.6
 )
@@ -0,0 +1,82 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	protobuf "p2p_client/grpc"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+)
+
+// clientConfig holds the settings NewStreamClient applies.
+type clientConfig struct {
+	creds       grpc.DialOption
+	keepalive   *keepalive.ClientParameters
+	dialTimeout time.Duration
+}
+
+// Option configures NewStreamClient.
+type Option func(*clientConfig)
+
+// WithCredentials sets the transport credentials, typically from
+// TLSFlags.DialOption. The default is plaintext.
+func WithCredentials(creds grpc.DialOption) Option {
+	return func(c *clientConfig) { c.creds = creds }
+}
+
+// WithKeepalive sends keepalive pings every interval, also while no stream
+// is open, and closes the connection if one is not acknowledged within
+// timeout. Without it gRPC's defaults apply.
+func WithKeepalive(interval, timeout time.Duration) Option {
+	return func(c *clientConfig) {
+		c.keepalive = &keepalive.ClientParameters{
+			Time:                interval,
+			Timeout:             timeout,
+			PermitWithoutStream: true,
+		}
+	}
+}
+
+// WithDialTimeout makes NewStreamClient wait up to d for the connection to
+// become ready (see WaitForReady). Zero, the default, does not wait.
+func WithDialTimeout(d time.Duration) Option {
+	return func(c *clientConfig) { c.dialTimeout = d }
+}
+
+// NewStreamClient connects to the sidecar at addr with unlimited message
+// sizes and returns the connection and a CommandStream client on it. With
+// WithDialTimeout it also waits for the connection to become ready, returning
+// ctx.Err() if ctx is canceled first. On error no connection is left open;
+// otherwise the caller closes conn.
+func NewStreamClient(ctx context.Context, addr string, opts ...Option) (*grpc.ClientConn, protobuf.CommandStreamClient, error) {
+	cfg := clientConfig{creds: grpc.WithTransportCredentials(insecure.NewCredentials())}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	dialOpts := []grpc.DialOption{
+		cfg.creds,
+		grpc.WithDefaultCallOptions(
+			grpc.MaxCallRecvMsgSize(math.MaxInt),
+			grpc.MaxCallSendMsgSize(math.MaxInt),
+		),
+	}
+	if cfg.keepalive != nil {
+		dialOpts = append(dialOpts, grpc.WithKeepaliveParams(*cfg.keepalive))
+	}
+
+	conn, err := grpc.NewClient(addr, dialOpts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	if err := WaitForReady(ctx, conn, cfg.dialTimeout); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, protobuf.NewCommandStreamClient(conn), nil
+}
@@ -0,0 +1,93 @@
+package shared
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is the severity of a log message.
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "DEBUG",
+	LevelInfo:  "INFO",
+	LevelWarn:  "WARN",
+	LevelError: "ERROR",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("Level(%d)", int32(l))
+}
+
+// ParseLevel parses a -log-level value (debug, info, warn or error).
+func ParseLevel(s string) (Level, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return l, nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return LevelWarn, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", s)
+}
+
+// Logger writes leveled messages through the standard log package, dropping
+// those below its current level. It is safe for concurrent use.
+type Logger struct {
+	level atomic.Int32
+}
+
+// Log is the logger shared by the client tools. Per-message output is logged
+// at debug level, so it is hidden unless the tool runs with -v.
+var Log = newLogger(LevelInfo)
+
+func newLogger(level Level) *Logger {
+	l := &Logger{}
+	l.SetLevel(level)
+	return l
+}
+
+// SetLevel changes the minimum level that is written.
+func (l *Logger) SetLevel(level Level) { l.level.Store(int32(level)) }
+
+// Enabled reports whether messages at level are written.
+func (l *Logger) Enabled(level Level) bool { return level >= Level(l.level.Load()) }
+
+func (l *Logger) logf(level Level, format string, args ...any) {
+	if !l.Enabled(level) {
+		return
+	}
+	_ = log.Output(3, level.String()+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Debugf(format string, args ...any) { l.logf(LevelDebug, format, args...) }
+func (l *Logger) Infof(format string, args ...any)  { l.logf(LevelInfo, format, args...) }
+func (l *Logger) Warnf(format string, args ...any)  { l.logf(LevelWarn, format, args...) }
+func (l *Logger) Errorf(format string, args ...any) { l.logf(LevelError, format, args...) }
+
+// ConfigureLogging applies the -log-level and -v flags to Log; verbose
+// forces debug level.
+func ConfigureLogging(level string, verbose bool) error {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	if verbose {
+		l = LevelDebug
+	}
+	Log.SetLevel(l)
+	return nil
+}
@@ -0,0 +1,207 @@
+package shared
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics holds the counters exposed by ServeMetrics in the Prometheus text
+// format. All methods are safe for concurrent use and are no-ops on a nil
+// *Metrics, so hot paths can call them unconditionally.
+type Metrics struct {
+	messagesSent     atomic.Uint64
+	bytesSent        atomic.Uint64
+	messagesReceived atomic.Uint64
+	bytesReceived    atomic.Uint64
+	decodeErrors     atomic.Uint64
+	checksummed      atomic.Uint64
+	integrityErrors  atomic.Uint64
+
+	mu          sync.Mutex
+	traceEvents map[traceEventKey]uint64
+}
+
+type traceEventKey struct {
+	topic string
+	typ   string
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{traceEvents: make(map[traceEventKey]uint64)}
+}
+
+// MessageSent records one published message of size bytes.
+func (m *Metrics) MessageSent(size int) {
+	if m == nil {
+		return
+	}
+	m.messagesSent.Add(1)
+	m.bytesSent.Add(uint64(size))
+}
+
+// MessageReceived records one received message of size bytes.
+func (m *Metrics) MessageReceived(size int) {
+	if m == nil {
+		return
+	}
+	m.messagesReceived.Add(1)
+	m.bytesReceived.Add(uint64(size))
+}
+
+// DecodeError records a message or trace event that could not be decoded.
+func (m *Metrics) DecodeError() {
+	if m == nil {
+		return
+	}
+	m.decodeErrors.Add(1)
+}
+
+// IntegrityChecked records a received message whose embedded checksum was
+// verified, and whether it matched.
+func (m *Metrics) IntegrityChecked(ok bool) {
+	if m == nil {
+		return
+	}
+	m.checksummed.Add(1)
+	if !ok {
+		m.integrityErrors.Add(1)
+	}
+}
+
+// MessagesReceived returns the number of received messages recorded so far.
+func (m *Metrics) MessagesReceived() uint64 {
+	if m == nil {
+		return 0
+	}
+	return m.messagesReceived.Load()
+}
+
+// DecodeErrors returns the number of decode errors recorded so far.
+func (m *Metrics) DecodeErrors() uint64 {
+	if m == nil {
+		return 0
+	}
+	return m.decodeErrors.Load()
+}
+
+// IntegrityFailures returns how many checksummed messages were received so
+// far and how many of them did not match their checksum.
+func (m *Metrics) IntegrityFailures() (checked, failed uint64) {
+	if m == nil {
+		return 0, 0
+	}
+	return m.checksummed.Load(), m.integrityErrors.Load()
+}
+
+// TraceEvent records one emitted trace event.
+func (m *Metrics) TraceEvent(topic, typ string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.traceEvents[traceEventKey{topic, typ}]++
+	m.mu.Unlock()
+}
+
+// PrintTraceTypes writes how many trace events of each type were emitted,
+// summed over topics, most frequent first. It prints nothing if there were
+// no trace events.
+func (m *Metrics) PrintTraceTypes() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	counts := make(map[string]uint64)
+	for k, n := range m.traceEvents {
+		counts[k.typ] += n
+	}
+	m.mu.Unlock()
+	if len(counts) == 0 {
+		return
+	}
+
+	types := make([]string, 0, len(counts))
+	for typ := range counts {
+		types = append(types, typ)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if counts[types[i]] != counts[types[j]] {
+			return counts[types[i]] > counts[types[j]]
+		}
+		return types[i] < types[j]
+	})
+	fmt.Println("Trace events by type:")
+	for _, typ := range types {
+		fmt.Printf("  %s: %d\n", typ, counts[typ])
+	}
+}
+
+// WriteTo writes all counters in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	counter := func(name, help string, v uint64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	counter("p2p_client_messages_sent_total", "Messages published.", m.messagesSent.Load())
+	counter("p2p_client_bytes_sent_total", "Payload bytes published.", m.bytesSent.Load())
+	counter("p2p_client_messages_received_total", "Messages received.", m.messagesReceived.Load())
+	counter("p2p_client_bytes_received_total", "Payload bytes received.", m.bytesReceived.Load())
+	counter("p2p_client_decode_errors_total", "Messages and trace events that failed to decode.", m.decodeErrors.Load())
+	counter("p2p_client_integrity_checked_total", "Received messages whose embedded checksum was verified.", m.checksummed.Load())
+	counter("p2p_client_integrity_failures_total", "Received messages whose body did not match the embedded checksum.", m.integrityErrors.Load())
+
+	m.mu.Lock()
+	keys := make([]traceEventKey, 0, len(m.traceEvents))
+	for k := range m.traceEvents {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].topic != keys[j].topic {
+			return keys[i].topic < keys[j].topic
+		}
+		return keys[i].typ < keys[j].typ
+	})
+	b.WriteString("# HELP p2p_client_trace_events_total Trace events emitted, by topic and event type.\n")
+	b.WriteString("# TYPE p2p_client_trace_events_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "p2p_client_trace_events_total{topic=\"%s\",type=\"%s\"} %d\n",
+			escapeLabel(k.topic), escapeLabel(k.typ), m.traceEvents[k])
+	}
+	m.mu.Unlock()
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = m.WriteTo(w)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+// ServeMetrics starts an HTTP server on addr exposing m at /metrics. It
+// returns once the listener is bound; serve errors are logged.
+func ServeMetrics(addr string, m *Metrics) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("metrics listen: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			Log.Errorf("metrics server: %v", err)
+		}
+	}()
+	Log.Infof("Serving metrics on http://%s/metrics", ln.Addr())
+	return nil
+}
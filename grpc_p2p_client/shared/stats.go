@@ -0,0 +1,492 @@
+package shared
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	optsub "p2p_client/grpc/mump2p_trace"
+)
+
+// KeyCounter tallies events per key (topic, IP, ...). It is safe for concurrent use.
+type KeyCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func NewKeyCounter() *KeyCounter {
+	return &KeyCounter{counts: make(map[string]int)}
+}
+
+func (c *KeyCounter) Inc(key string) {
+	c.mu.Lock()
+	c.counts[key]++
+	c.mu.Unlock()
+}
+
+func (c *KeyCounter) Get(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[key]
+}
+
+// Print writes the per-key totals sorted by key.
+func (c *KeyCounter) Print() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0, len(c.counts))
+	for k := range c.counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("  %s: %d\n", k, c.counts[k])
+	}
+}
+
+// LatencyStats tracks end-to-end publish-to-receive latency. It is safe for concurrent use.
+type LatencyStats struct {
+	mu       sync.Mutex
+	samples  int
+	unparsed int
+	min, max time.Duration
+	total    time.Duration
+}
+
+func NewLatencyStats() *LatencyStats {
+	return &LatencyStats{}
+}
+
+// Observe records the latency of a message whose payload starts with the
+// "[unixNano size]" prefix written by the publish tools. Messages without a
+// parseable prefix are counted separately and excluded from the statistics.
+func (l *LatencyStats) Observe(msg []byte, received time.Time) {
+	sent, ok := ParsePublishTimestamp(msg)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !ok {
+		l.unparsed++
+		return
+	}
+	d := received.Sub(sent)
+	if l.samples == 0 || d < l.min {
+		l.min = d
+	}
+	if l.samples == 0 || d > l.max {
+		l.max = d
+	}
+	l.total += d
+	l.samples++
+}
+
+func (l *LatencyStats) Print() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.samples == 0 {
+		fmt.Printf("Latency: no timestamped messages (%d without prefix)\n", l.unparsed)
+		return
+	}
+	avg := l.total / time.Duration(l.samples)
+	fmt.Printf("Latency over %d messages: min=%v avg=%v max=%v (%d without prefix)\n",
+		l.samples, l.min, avg, l.max, l.unparsed)
+}
+
+// ParsePublishTimestamp extracts the publish time from a "[unixNano size] ..." payload.
+func ParsePublishTimestamp(msg []byte) (time.Time, bool) {
+	if len(msg) == 0 || msg[0] != '[' {
+		return time.Time{}, false
+	}
+	end := strings.IndexByte(string(msg[:min(len(msg), 64)]), ']')
+	if end < 0 {
+		return time.Time{}, false
+	}
+	fields := strings.Fields(string(msg[1:end]))
+	if len(fields) != 2 {
+		return time.Time{}, false
+	}
+	ns, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+// HashSet is a concurrency-safe set of message hashes.
+type HashSet struct {
+	mu     sync.Mutex
+	hashes map[string]struct{}
+}
+
+func NewHashSet() *HashSet {
+	return &HashSet{hashes: make(map[string]struct{})}
+}
+
+// Add inserts hash and reports whether it was not already present.
+func (s *HashSet) Add(hash string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.hashes[hash]; ok {
+		return false
+	}
+	s.hashes[hash] = struct{}{}
+	return true
+}
+
+// ShardCounts holds the shard events seen for one message.
+type ShardCounts struct {
+	New       int
+	Duplicate int
+	Unhelpful int
+}
+
+func (c ShardCounts) Total() int {
+	return c.New + c.Duplicate + c.Unhelpful
+}
+
+// maxHopEntries bounds HopIndex; the oldest entries are evicted first, which
+// only matters for messages whose data never arrives.
+const maxHopEntries = 100000
+
+type hopKey struct {
+	ip    string
+	msgID string
+}
+
+// HopIndex remembers, per receiving node and base58 message ID, the peer the
+// node received the message from according to its trace events. It is safe
+// for concurrent use.
+type HopIndex struct {
+	mu    sync.Mutex
+	peers map[hopKey]string
+	order []hopKey
+}
+
+func NewHopIndex() *HopIndex {
+	return &HopIndex{peers: make(map[hopKey]string)}
+}
+
+// Observe records the received-from peer of a trace event seen on ip. A
+// DELIVER_MESSAGE event names the peer that delivered the message and always
+// wins; otherwise the first shard's sender is kept.
+func (h *HopIndex) Observe(ip string, rec TraceRecord) {
+	if h == nil || rec.MessageID == "" || rec.ReceivedFrom == "" {
+		return
+	}
+	k := hopKey{ip, rec.MessageID}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.peers[k]; ok {
+		if rec.Type == optsub.TraceEvent_DELIVER_MESSAGE.String() {
+			h.peers[k] = rec.ReceivedFrom
+		}
+		return
+	}
+	if len(h.order) >= maxHopEntries {
+		delete(h.peers, h.order[0])
+		h.order = h.order[1:]
+	}
+	h.peers[k] = rec.ReceivedFrom
+	h.order = append(h.order, k)
+}
+
+// Lookup returns the peer ip received msgID from, if a trace event for it
+// has been seen.
+func (h *HopIndex) Lookup(ip, msgID string) (string, bool) {
+	if h == nil {
+		return "", false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p, ok := h.peers[hopKey{ip, msgID}]
+	return p, ok
+}
+
+// ShardStats aggregates OptimumP2P shard events per base58 message ID. It is
+// safe for concurrent use.
+type ShardStats struct {
+	mu       sync.Mutex
+	messages map[string]*ShardCounts
+}
+
+func NewShardStats() *ShardStats {
+	return &ShardStats{messages: make(map[string]*ShardCounts)}
+}
+
+// Observe records a trace event; events other than NEW_SHARD, DUPLICATE_SHARD
+// and UNHELPFUL_SHARD are ignored.
+func (s *ShardStats) Observe(msgID string, typ optsub.TraceEvent_Type) {
+	if msgID == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.messages[msgID]
+	if c == nil {
+		switch typ {
+		case optsub.TraceEvent_NEW_SHARD, optsub.TraceEvent_DUPLICATE_SHARD, optsub.TraceEvent_UNHELPFUL_SHARD:
+			c = &ShardCounts{}
+			s.messages[msgID] = c
+		default:
+			return
+		}
+	}
+	switch typ {
+	case optsub.TraceEvent_NEW_SHARD:
+		c.New++
+	case optsub.TraceEvent_DUPLICATE_SHARD:
+		c.Duplicate++
+	case optsub.TraceEvent_UNHELPFUL_SHARD:
+		c.Unhelpful++
+	}
+}
+
+// Print writes per-message shard totals followed by a histogram of how many
+// new shards each message needed.
+func (s *ShardStats) Print() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]string, 0, len(s.messages))
+	for id := range s.messages {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	fmt.Printf("Shard statistics for %d messages:\n", len(ids))
+	histogram := make(map[int]int)
+	for _, id := range ids {
+		c := s.messages[id]
+		fmt.Printf("  %s new=%d duplicate=%d unhelpful=%d total=%d\n",
+			id, c.New, c.Duplicate, c.Unhelpful, c.Total())
+		histogram[c.New]++
+	}
+
+	buckets := make([]int, 0, len(histogram))
+	for n := range histogram {
+		buckets = append(buckets, n)
+	}
+	sort.Ints(buckets)
+	fmt.Println("New shards per message:")
+	for _, n := range buckets {
+		fmt.Printf("  %d: %d message(s)\n", n, histogram[n])
+	}
+}
+
+type sequenceState struct {
+	seen   map[uint64]struct{}
+	max    uint64
+	copies int
+}
+
+// SequenceTracker records the sequence numbers received from each publisher
+// to report gaps. It is safe for concurrent use.
+type SequenceTracker struct {
+	mu      sync.Mutex
+	senders map[string]*sequenceState
+}
+
+func NewSequenceTracker() *SequenceTracker {
+	return &SequenceTracker{senders: make(map[string]*sequenceState)}
+}
+
+func (t *SequenceTracker) Observe(sender string, seq uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st := t.senders[sender]
+	if st == nil {
+		st = &sequenceState{seen: make(map[uint64]struct{})}
+		t.senders[sender] = st
+	}
+	st.copies++
+	st.seen[seq] = struct{}{}
+	if seq > st.max {
+		st.max = seq
+	}
+}
+
+// maxReportedGaps caps how many missing ranges Print lists per sender; the
+// missing count is always complete.
+const maxReportedGaps = 20
+
+// Print writes, per sender, the highest sequence seen, how many distinct
+// sequence numbers arrived and which ones in [0, highest] are missing, listing
+// at most maxReportedGaps ranges. It prints nothing if no sequenced messages
+// were observed.
+func (t *SequenceTracker) Print() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.senders) == 0 {
+		return
+	}
+	senders := make([]string, 0, len(t.senders))
+	for s := range t.senders {
+		senders = append(senders, s)
+	}
+	sort.Strings(senders)
+
+	fmt.Println("Sequence report:")
+	for _, sender := range senders {
+		st := t.senders[sender]
+		gaps, more := st.gaps(maxReportedGaps)
+		fmt.Printf("  %s: highest=%d received=%d copies=%d missing=%d",
+			sender, st.max, len(st.seen), st.copies, st.max+1-uint64(len(st.seen)))
+		if len(gaps) > 0 {
+			if more {
+				gaps = append(gaps, "...")
+			}
+			fmt.Printf(" [%s]", strings.Join(gaps, ","))
+		}
+		fmt.Println()
+	}
+}
+
+// gaps returns up to limit missing ranges in [0, max], such as "3" or
+// "5-9", and whether there are more. It walks the sorted sequence numbers
+// received, so its cost does not depend on how large max is.
+func (st *sequenceState) gaps(limit int) ([]string, bool) {
+	seqs := make([]uint64, 0, len(st.seen))
+	for seq := range st.seen {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	var out []string
+	next := uint64(0) // lowest sequence number not yet accounted for
+	for _, seq := range seqs {
+		if seq > next {
+			if len(out) == limit {
+				return out, true
+			}
+			if seq-1 == next {
+				out = append(out, strconv.FormatUint(next, 10))
+			} else {
+				out = append(out, fmt.Sprintf("%d-%d", next, seq-1))
+			}
+		}
+		next = seq + 1
+	}
+	return out, false
+}
+
+// SequencePrefix, PublisherPrefix and ChecksumPrefix start the fields of the
+// PayloadHeader that multi-publish prepends to each payload.
+const (
+	SequencePrefix  = "seq="
+	PublisherPrefix = "pub="
+	ChecksumPrefix  = "sum="
+)
+
+// PayloadHeader identifies a message published by multi-publish.
+type PayloadHeader struct {
+	Seq       uint64
+	Publisher string
+	// Sum is the hex sha256 of the body. EncodePayload computes it; it is
+	// empty for payloads from publishers that did not embed one.
+	Sum string
+}
+
+// randomSuffixBytes is the random part of RandomSuffix; 16 bytes make
+// collisions between generated messages negligible.
+const randomSuffixBytes = 16
+
+// processNonce is generated once per process and starts every RandomSuffix,
+// so messages from concurrent runs never share a suffix.
+var processNonce = func() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("generate process nonce: %v", err))
+	}
+	return hex.EncodeToString(b)
+}()
+
+// RandomSuffix returns the hex-encoded process nonce followed by 16 fresh
+// random bytes, for the generated messages of the publish tools. Together
+// with the message index it keeps every generated payload, and so its sha256,
+// distinct.
+func RandomSuffix() (string, error) {
+	b := make([]byte, randomSuffixBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %v", err)
+	}
+	return processNonce + hex.EncodeToString(b), nil
+}
+
+// EncodePayload prepends h to body as "seq=<n> pub=<publisher> sum=<sha256> ",
+// so the publisher can be recovered whatever the body contains and receivers
+// can check that the body arrived intact. h.Sum is ignored and computed from
+// body. The publisher must be non-empty and contain no spaces.
+func EncodePayload(h PayloadHeader, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	header := fmt.Sprintf("%s%d %s%s %s%x ", SequencePrefix, h.Seq, PublisherPrefix, h.Publisher, ChecksumPrefix, sum)
+	return append([]byte(header), body...)
+}
+
+// ParsePayload splits a payload built by EncodePayload into its header and
+// body. It returns false, and msg unchanged, if msg has no such header. The
+// sum= field is optional, so headers without one still parse.
+func ParsePayload(msg []byte) (PayloadHeader, []byte, bool) {
+	seq, rest, ok := ParseSequence(msg)
+	if !ok || !bytes.HasPrefix(rest, []byte(PublisherPrefix)) {
+		return PayloadHeader{}, msg, false
+	}
+	end := bytes.IndexByte(rest, ' ')
+	if end <= len(PublisherPrefix) {
+		return PayloadHeader{}, msg, false
+	}
+	h := PayloadHeader{Seq: seq, Publisher: string(rest[len(PublisherPrefix):end])}
+	rest = rest[end+1:]
+
+	const sumLen = len(ChecksumPrefix) + 2*sha256.Size
+	if len(rest) > sumLen && rest[sumLen] == ' ' && bytes.HasPrefix(rest, []byte(ChecksumPrefix)) {
+		h.Sum = string(rest[len(ChecksumPrefix):sumLen])
+		rest = rest[sumLen+1:]
+	}
+	return h, rest, true
+}
+
+// CheckPayloadSum reports whether msg carries a PayloadHeader checksum and,
+// if so, whether it matches the sha256 of the body.
+func CheckPayloadSum(msg []byte) (checked, ok bool) {
+	h, body, parsed := ParsePayload(msg)
+	if !parsed || h.Sum == "" {
+		return false, false
+	}
+	sum := sha256.Sum256(body)
+	return true, hex.EncodeToString(sum[:]) == h.Sum
+}
+
+// MaxSequence is the largest sequence number ParseSequence accepts. The
+// publish tools count from 0, so anything larger is not one of their headers.
+const MaxSequence = 1 << 40
+
+// ParseSequence splits a "seq=<n> <rest>" payload into its sequence number
+// and the remaining payload. Numbers above MaxSequence are rejected.
+func ParseSequence(msg []byte) (uint64, []byte, bool) {
+	s := string(msg[:min(len(msg), 32)])
+	if !strings.HasPrefix(s, SequencePrefix) {
+		return 0, msg, false
+	}
+	end := strings.IndexByte(s, ' ')
+	if end < 0 {
+		return 0, msg, false
+	}
+	seq, err := strconv.ParseUint(s[len(SequencePrefix):end], 10, 64)
+	if err != nil || seq > MaxSequence {
+		return 0, msg, false
+	}
+	return seq, msg[end+1:], true
+}
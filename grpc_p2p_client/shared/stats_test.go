@@ -0,0 +1,142 @@
+package shared
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseSequence(t *testing.T) {
+	tests := []struct {
+		msg  string
+		seq  uint64
+		rest string
+		ok   bool
+	}{
+		{"seq=0 body", 0, "body", true},
+		{"seq=42 10.0.0.1-abc", 42, "10.0.0.1-abc", true},
+		{fmt.Sprintf("seq=%d x", uint64(MaxSequence)), MaxSequence, "x", true},
+		{fmt.Sprintf("seq=%d x", uint64(MaxSequence)+1), 0, fmt.Sprintf("seq=%d x", uint64(MaxSequence)+1), false},
+		{"seq=18446744073709551615 x", 0, "seq=18446744073709551615 x", false},
+		{"seq=-1 x", 0, "seq=-1 x", false},
+		{"seq=12", 0, "seq=12", false},
+		{"10.0.0.1-abc", 0, "10.0.0.1-abc", false},
+	}
+	for _, tt := range tests {
+		seq, rest, ok := ParseSequence([]byte(tt.msg))
+		if seq != tt.seq || string(rest) != tt.rest || ok != tt.ok {
+			t.Errorf("ParseSequence(%q) = %d, %q, %v; want %d, %q, %v", tt.msg, seq, rest, ok, tt.seq, tt.rest, tt.ok)
+		}
+	}
+}
+
+func TestSequenceGaps(t *testing.T) {
+	tests := []struct {
+		name  string
+		seqs  []uint64
+		limit int
+		want  []string
+		more  bool
+	}{
+		{"complete", []uint64{0, 1, 2}, 20, nil, false},
+		{"duplicates", []uint64{0, 0, 1, 1}, 20, nil, false},
+		{"single and range", []uint64{1, 2, 4, 9}, 20, []string{"0", "3", "5-8"}, false},
+		{"limited", []uint64{1, 3, 5, 7}, 2, []string{"0", "2"}, true},
+		{"exactly limit", []uint64{1, 3}, 2, []string{"0", "2"}, false},
+		{"huge gap", []uint64{0, MaxSequence}, 20, []string{fmt.Sprintf("1-%d", uint64(MaxSequence)-1)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := NewSequenceTracker()
+			for _, s := range tt.seqs {
+				tr.Observe("a", s)
+			}
+			got, more := tr.senders["a"].gaps(tt.limit)
+			if !reflect.DeepEqual(got, tt.want) || more != tt.more {
+				t.Errorf("gaps(%d) = %v, %v; want %v, %v", tt.limit, got, more, tt.want, tt.more)
+			}
+		})
+	}
+}
+
+func TestPayloadRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		h    PayloadHeader
+		body string
+	}{
+		{"simple", PayloadHeader{Seq: 0, Publisher: "10.0.0.1:33212"}, "abcdef"},
+		{"empty body", PayloadHeader{Seq: 7, Publisher: "p"}, ""},
+		{"body with dashes", PayloadHeader{Seq: 1, Publisher: "10.0.0.1:33212"}, "10.0.0.2-a-b-c"},
+		{"body with a header", PayloadHeader{Seq: 42, Publisher: "[::1]:33212"}, "seq=1 pub=x sum=y tail"},
+		{"max sequence", PayloadHeader{Seq: MaxSequence, Publisher: "p"}, "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := EncodePayload(tt.h, []byte(tt.body))
+			h, body, ok := ParsePayload(msg)
+			if !ok {
+				t.Fatalf("ParsePayload(%q) failed", msg)
+			}
+			if h.Seq != tt.h.Seq || h.Publisher != tt.h.Publisher {
+				t.Errorf("header = %+v, want seq %d pub %q", h, tt.h.Seq, tt.h.Publisher)
+			}
+			if string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestParsePayload(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		ok   bool
+		want PayloadHeader
+		body string
+	}{
+		{"no sum", "seq=3 pub=a body", true, PayloadHeader{Seq: 3, Publisher: "a"}, "body"},
+		{"legacy payload", "10.0.0.1-abc", false, PayloadHeader{}, "10.0.0.1-abc"},
+		{"sequence only", "seq=3 body", false, PayloadHeader{}, "seq=3 body"},
+		{"empty publisher", "seq=3 pub= body", false, PayloadHeader{}, "seq=3 pub= body"},
+		{"no space after publisher", "seq=3 pub=a", false, PayloadHeader{}, "seq=3 pub=a"},
+		{"bad sequence", "seq=x pub=a body", false, PayloadHeader{}, "seq=x pub=a body"},
+		{"sequence above max", fmt.Sprintf("seq=%d pub=a body", uint64(MaxSequence)+1), false, PayloadHeader{},
+			fmt.Sprintf("seq=%d pub=a body", uint64(MaxSequence)+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, body, ok := ParsePayload([]byte(tt.msg))
+			if ok != tt.ok || h != tt.want || string(body) != tt.body {
+				t.Errorf("ParsePayload(%q) = %+v, %q, %v; want %+v, %q, %v", tt.msg, h, body, ok, tt.want, tt.body, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCheckPayloadSum(t *testing.T) {
+	msg := EncodePayload(PayloadHeader{Seq: 1, Publisher: "a"}, []byte("hello"))
+	tests := []struct {
+		name        string
+		msg         []byte
+		checked, ok bool
+	}{
+		{"intact", msg, true, true},
+		{"empty body", EncodePayload(PayloadHeader{Publisher: "a"}, nil), true, true},
+		{"corrupt body", bytes.Replace(msg, []byte("hello"), []byte("jello"), 1), true, false},
+		{"truncated body", msg[:len(msg)-1], true, false},
+		{"no sum", []byte("seq=1 pub=a hello"), false, false},
+		{"no header", []byte("10.0.0.1-hello"), false, false},
+	}
+	for _, tt := range tests {
+		if checked, ok := CheckPayloadSum(tt.msg); checked != tt.checked || ok != tt.ok {
+			t.Errorf("%s: CheckPayloadSum = %v, %v; want %v, %v", tt.name, checked, ok, tt.checked, tt.ok)
+		}
+	}
+	h, _, _ := ParsePayload(msg)
+	if len(h.Sum) != 64 {
+		t.Errorf("Sum = %q, want 64 hex digits", h.Sum)
+	}
+}
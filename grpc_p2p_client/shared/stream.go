@@ -0,0 +1,189 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	protobuf "p2p_client/grpc"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+// Sleep waits for d, returning early if ctx is canceled. It reports whether
+// the full duration elapsed; a d <= 0 returns at once.
+func Sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// WaitForReady starts connecting conn and waits up to timeout for it to
+// become ready. grpc.NewClient is lazy, so without this an unreachable host
+// stalls the first RPC until the OS TCP timeout. A timeout <= 0 skips the wait.
+func WaitForReady(ctx context.Context, conn *grpc.ClientConn, timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn.Connect()
+	for {
+		state := conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.Shutdown:
+			return fmt.Errorf("connection to %s shut down", conn.Target())
+		}
+		if !conn.WaitForStateChange(waitCtx, state) {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("%s not reachable within %v (last state %s)", conn.Target(), timeout, state)
+		}
+	}
+}
+
+// RecvOutcome says what a receive loop should do after stream.Recv failed.
+type RecvOutcome int
+
+const (
+	// RecvClosed: the sidecar ended the stream normally (io.EOF).
+	RecvClosed RecvOutcome = iota
+	// RecvCanceled: the client is shutting down; not an error.
+	RecvCanceled
+	// RecvRetry: a transient failure such as Unavailable; reconnect.
+	RecvRetry
+	// RecvBackoff: the sidecar is limiting this client (ResourceExhausted or
+	// too_many_pings); reconnect, but wait longer first.
+	RecvBackoff
+	// RecvFatal: retrying cannot help (e.g. InvalidArgument, PermissionDenied,
+	// Unimplemented); give up.
+	RecvFatal
+)
+
+var recvOutcomeNames = map[RecvOutcome]string{
+	RecvClosed:   "closed",
+	RecvCanceled: "canceled",
+	RecvRetry:    "retry",
+	RecvBackoff:  "backoff",
+	RecvFatal:    "fatal",
+}
+
+func (o RecvOutcome) String() string {
+	if name, ok := recvOutcomeNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("RecvOutcome(%d)", int(o))
+}
+
+// ClassifyRecvError maps an error from stream.Recv, possibly wrapped, to a
+// RecvOutcome using its gRPC status code. Errors without a status, such as a
+// failed dial, are treated as transient.
+func ClassifyRecvError(err error) RecvOutcome {
+	switch {
+	case err == nil, errors.Is(err, io.EOF):
+		return RecvClosed
+	case errors.Is(err, context.Canceled):
+		return RecvCanceled
+	case IsTooManyPings(err):
+		return RecvBackoff
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return RecvRetry
+	}
+	switch st.Code() {
+	case codes.Canceled:
+		return RecvCanceled
+	case codes.ResourceExhausted:
+		return RecvBackoff
+	case codes.InvalidArgument, codes.NotFound, codes.AlreadyExists, codes.PermissionDenied,
+		codes.FailedPrecondition, codes.OutOfRange, codes.Unimplemented, codes.Unauthenticated:
+		return RecvFatal
+	default:
+		return RecvRetry
+	}
+}
+
+// MaxKeepaliveInterval caps how far WidenKeepalive backs off.
+const MaxKeepaliveInterval = 30 * time.Minute
+
+// IsTooManyPings reports whether err is the sidecar closing the connection
+// with ENHANCE_YOUR_CALM / too_many_pings, i.e. the client's keepalive pings
+// are more frequent than the server's enforcement policy allows. Reconnecting
+// with the same interval only hits the same error again.
+func IsTooManyPings(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "too_many_pings") || strings.Contains(msg, "ENHANCE_YOUR_CALM")
+}
+
+// WidenKeepalive logs guidance for a too_many_pings error on the connection
+// to addr and returns the keepalive interval to reconnect with: twice d,
+// capped at MaxKeepaliveInterval. The bool is false once d has already
+// reached the cap, in which case the caller should give up.
+func WidenKeepalive(addr string, d time.Duration) (time.Duration, bool) {
+	if d >= MaxKeepaliveInterval {
+		Log.Errorf("[%s] sidecar still rejects keepalive pings every %v (too_many_pings); check its keepalive enforcement policy", addr, d)
+		return d, false
+	}
+	next := min(2*d, MaxKeepaliveInterval)
+	Log.Warnf("[%s] sidecar closed the connection with too_many_pings: keepalive pings every %v are more frequent than it allows; reconnecting with %v (set -keepalive-interval to at least this to avoid the error)", addr, d, next)
+	return next, true
+}
+
+// EnsureSubscribed subscribes stream to topic and blocks until the sidecar
+// sends its first response on the stream or timeout elapses. Publishing on
+// the same node before the subscription is active can fail with "topic not
+// assigned".
+//
+// The sidecar protocol has no subscription acknowledgement, so this is only
+// a heuristic: any first response, including a delivered message or a trace
+// event, is taken as evidence that the subscription is active. That response
+// is returned so the caller can handle it. The receive runs on the caller's
+// goroutine; on timeout cancelStream is called to abort it, which leaves the
+// stream unusable, so no receive is left behind to race with the caller's
+// own.
+func EnsureSubscribed(stream protobuf.CommandStream_ListenCommandsClient, cancelStream context.CancelFunc,
+	topic string, timeout time.Duration) (*protobuf.Response, error) {
+
+	req := &protobuf.Request{
+		Command: int32(CommandSubscribeToTopic),
+		Topic:   topic,
+	}
+	if err := stream.Send(req); err != nil {
+		return nil, fmt.Errorf("send subscribe: %w", err)
+	}
+
+	timer := time.AfterFunc(timeout, cancelStream)
+	resp, err := stream.Recv()
+	if !timer.Stop() {
+		return nil, fmt.Errorf("no response to the subscription to %q within %v", topic, timeout)
+	}
+	if err == io.EOF {
+		return nil, fmt.Errorf("stream closed before subscription to %q was confirmed", topic)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("subscribe to %q: %w", topic, err)
+	}
+	return resp, nil
+}
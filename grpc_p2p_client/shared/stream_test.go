@@ -0,0 +1,41 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassifyRecvError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want RecvOutcome
+	}{
+		{"nil", nil, RecvClosed},
+		{"eof", io.EOF, RecvClosed},
+		{"wrapped eof", fmt.Errorf("recv: %w", io.EOF), RecvClosed},
+		{"context canceled", context.Canceled, RecvCanceled},
+		{"status canceled", status.Error(codes.Canceled, "bye"), RecvCanceled},
+		{"too many pings", status.Error(codes.Unavailable, "closing transport due to: ENHANCE_YOUR_CALM, debug data: \"too_many_pings\""), RecvBackoff},
+		{"resource exhausted", status.Error(codes.ResourceExhausted, "slow down"), RecvBackoff},
+		{"unavailable", status.Error(codes.Unavailable, "connection refused"), RecvRetry},
+		{"deadline", status.Error(codes.DeadlineExceeded, "timeout"), RecvRetry},
+		{"unauthenticated", status.Error(codes.Unauthenticated, "no"), RecvFatal},
+		{"not found", status.Error(codes.NotFound, "topic not assigned"), RecvFatal},
+		{"wrapped fatal", fmt.Errorf("recv: %w", status.Error(codes.PermissionDenied, "no")), RecvFatal},
+		{"no status", errors.New("dial failed"), RecvRetry},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyRecvError(tt.err); got != tt.want {
+				t.Errorf("ClassifyRecvError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package shared
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// TLSFlags holds the transport security settings shared by the client tools.
+type TLSFlags struct {
+	Enabled  bool
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// RegisterTLSFlags defines -tls, -tls-ca, -tls-cert and -tls-key on fs.
+func RegisterTLSFlags(fs *flag.FlagSet) *TLSFlags {
+	f := &TLSFlags{}
+	fs.BoolVar(&f.Enabled, "tls", false, "connect with TLS instead of plaintext")
+	fs.StringVar(&f.CAFile, "tls-ca", "", "PEM CA bundle used to verify the server (default: system roots)")
+	fs.StringVar(&f.CertFile, "tls-cert", "", "PEM client certificate for mutual TLS (requires -tls-key)")
+	fs.StringVar(&f.KeyFile, "tls-key", "", "PEM client private key for mutual TLS (requires -tls-cert)")
+	return f
+}
+
+// DialOption returns the transport credentials option for grpc.NewClient:
+// insecure without -tls, otherwise TLS verified against -tls-ca (or the
+// system roots) with an optional client certificate.
+func (f *TLSFlags) DialOption() (grpc.DialOption, error) {
+	if !f.Enabled {
+		if f.CAFile != "" || f.CertFile != "" || f.KeyFile != "" {
+			return nil, fmt.Errorf("-tls-ca, -tls-cert and -tls-key require -tls")
+		}
+		return grpc.WithTransportCredentials(insecure.NewCredentials()), nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if f.CAFile != "" {
+		pem, err := os.ReadFile(f.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read -tls-ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("-tls-ca %s: no PEM certificates found", f.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if (f.CertFile == "") != (f.KeyFile == "") {
+		return nil, fmt.Errorf("-tls-cert and -tls-key must be set together")
+	}
+	if f.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(cfg)), nil
+}
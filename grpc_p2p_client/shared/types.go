@@ -17,3 +17,10 @@ const (
 	CommandSubscribeToTopic
 	CommandUnSubscribeToTopic
 )
+
+// HashColumn is the header name of the message hash column in publish and subscribe output files.
+const HashColumn = "sha256(msg)"
+
+// ReceivedFromColumn is the header name of the optional data column holding
+// the peer a node received each message from.
+const ReceivedFromColumn = "received_from"
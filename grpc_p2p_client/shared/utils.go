@@ -2,13 +2,19 @@ package shared
 
 import (
 	"bufio"
+	"compress/gzip"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -22,7 +28,14 @@ import (
 	"github.com/mr-tron/base58"
 )
 
-func ReadIPsFromFile(filename string) ([]string, error) {
+// ReadIPsFromFile returns the host:port endpoints listed in filename, one per
+// line. Blank lines and lines starting with # are skipped. Besides literal
+// endpoints, a line may be an inclusive address range
+// (10.0.0.1-10.0.0.50:33212) or a CIDR block (10.0.1.0/28:33212), which are
+// expanded into one endpoint per address. Entries without a port get
+// defaultPort; if defaultPort is empty they are rejected. Malformed entries
+// are reported with their line number.
+func ReadIPsFromFile(filename, defaultPort string) ([]string, error) {
 	if strings.TrimSpace(filename) == "" {
 		return nil, fmt.Errorf("-ipfile is required")
 	}
@@ -36,12 +49,18 @@ func ReadIPsFromFile(filename string) ([]string, error) {
 	var ips []string
 	scanner := bufio.NewScanner(file)
 
+	lineNo := 0
 	for scanner.Scan() {
+		lineNo++
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-		ips = append(ips, line)
+		expanded, err := expandEndpoint(line, defaultPort)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, lineNo, err)
+		}
+		ips = append(ips, expanded...)
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -51,6 +70,170 @@ func ReadIPsFromFile(filename string) ([]string, error) {
 	return ips, nil
 }
 
+// maxExpandedEndpoints bounds how many endpoints a single range or CIDR line may produce.
+const maxExpandedEndpoints = 1 << 16
+
+// splitEndpoint splits entry into host and port. The port is empty when the
+// entry has none; IPv6 hosts with a port must be bracketed ([::1]:33212).
+func splitEndpoint(entry string) (host, port string, err error) {
+	if rest, ok := strings.CutPrefix(entry, "["); ok {
+		host, rest, ok = strings.Cut(rest, "]")
+		if !ok {
+			return "", "", fmt.Errorf("invalid endpoint %q: missing ']'", entry)
+		}
+		if rest == "" {
+			return host, "", nil
+		}
+		port, ok = strings.CutPrefix(rest, ":")
+		if !ok {
+			return "", "", fmt.Errorf("invalid endpoint %q: unexpected %q after ']'", entry, rest)
+		}
+		return host, port, nil
+	}
+	if strings.Count(entry, ":") == 1 {
+		host, port, _ = strings.Cut(entry, ":")
+		return host, port, nil
+	}
+	return entry, "", nil
+}
+
+// NormalizeEndpoint validates a single host[:port] entry and returns it in
+// host:port form, appending defaultPort when the entry has no port.
+func NormalizeEndpoint(entry, defaultPort string) (string, error) {
+	host, port, err := splitEndpoint(entry)
+	if err != nil {
+		return "", err
+	}
+	return joinEndpoint(entry, host, port, defaultPort)
+}
+
+func joinEndpoint(entry, host, port, defaultPort string) (string, error) {
+	if host == "" || strings.ContainsAny(host, " \t/") {
+		return "", fmt.Errorf("invalid endpoint %q: bad host %q", entry, host)
+	}
+	if port == "" {
+		if defaultPort == "" {
+			return "", fmt.Errorf("invalid endpoint %q: missing port", entry)
+		}
+		port = defaultPort
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid endpoint %q: bad port %q", entry, port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// expandEndpoint expands a range or CIDR entry into host:port endpoints.
+// Any other entry is normalized and returned on its own.
+func expandEndpoint(entry, defaultPort string) ([]string, error) {
+	host, port, err := splitEndpoint(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []netip.Addr
+	switch {
+	case strings.Contains(host, "/"):
+		prefix, err := netip.ParsePrefix(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", host, err)
+		}
+		prefix = prefix.Masked()
+		for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+			if len(addrs) == maxExpandedEndpoints {
+				return nil, fmt.Errorf("CIDR %q expands to more than %d endpoints", host, maxExpandedEndpoints)
+			}
+			addrs = append(addrs, addr)
+		}
+
+	case strings.Contains(host, "-"):
+		from, to, _ := strings.Cut(host, "-")
+		start, err := netip.ParseAddr(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range start %q: %w", from, err)
+		}
+		end, err := netip.ParseAddr(to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range end %q: %w", to, err)
+		}
+		if start.BitLen() != end.BitLen() || end.Less(start) {
+			return nil, fmt.Errorf("invalid range %q: end must not precede start", host)
+		}
+		for addr := start; addr.IsValid() && !end.Less(addr); addr = addr.Next() {
+			if len(addrs) == maxExpandedEndpoints {
+				return nil, fmt.Errorf("range %q expands to more than %d endpoints", host, maxExpandedEndpoints)
+			}
+			addrs = append(addrs, addr)
+		}
+
+	default:
+		ep, err := joinEndpoint(entry, host, port, defaultPort)
+		if err != nil {
+			return nil, err
+		}
+		return []string{ep}, nil
+	}
+
+	out := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ep, err := joinEndpoint(entry, addr.String(), port, defaultPort)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ep)
+	}
+	return out, nil
+}
+
+// ReadTSVFile reads a tab-separated file written by WriteToFile, transparently
+// decompressing ".gz" files. If the first line contains the sha256(msg) column
+// name it is returned as the header.
+func ReadTSVFile(filename string) ([]string, [][]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	var in io.Reader = file
+	if strings.HasSuffix(filename, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open gzip stream: %w", err)
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	var header []string
+	var rows [][]string
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	first := true
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		cols := strings.Split(line, "\t")
+		if first {
+			first = false
+			if strings.Contains(line, HashColumn) {
+				header = cols
+				continue
+			}
+		}
+		rows = append(rows, cols)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error reading file: %w", err)
+	}
+
+	return header, rows, nil
+}
+
 func HeadHex(b []byte, n int) string {
 	if len(b) > n {
 		b = b[:n]
@@ -58,65 +241,303 @@ func HeadHex(b []byte, n int) string {
 	return hex.EncodeToString(b)
 }
 
-func HandleResponse(resp *protobuf.Response, counter *int32) {
+// HandleResponse prints a received message and bumps counter. If topics is
+// non-nil the message is also tallied under its topic, and if latency is
+// non-nil its end-to-end latency is recorded.
+func HandleResponse(resp *protobuf.Response, counter *int32, topics *KeyCounter, latency *LatencyStats) {
 	switch resp.GetCommand() {
 	case protobuf.ResponseType_Message:
 		var p2pMessage P2PMessage
 		if err := json.Unmarshal(resp.GetData(), &p2pMessage); err != nil {
-			log.Printf("Error unmarshalling message: %v", err)
+			Log.Warnf("Error unmarshalling message: %v", err)
 			return
 		}
 		n := atomic.AddInt32(counter, 1)
+		if topics != nil {
+			topics.Inc(p2pMessage.Topic)
+		}
 		messageSize := len(p2pMessage.Message)
-		currentTime := time.Now().UnixNano()
-		fmt.Printf("Recv message: [%d] [%d %d] %s\n\n", n, currentTime, messageSize, string(p2pMessage.Message))
+		now := time.Now()
+		currentTime := now.UnixNano()
+		if latency != nil {
+			latency.Observe(p2pMessage.Message, now)
+		}
+		Log.Debugf("Recv message: [%d] [%d %d] %s", n, currentTime, messageSize, string(p2pMessage.Message))
 	case protobuf.ResponseType_MessageTraceGossipSub:
-		log.Printf("GossipSub trace received but handler not implemented")
+		Log.Debugf("GossipSub trace received but handler not implemented")
 	case protobuf.ResponseType_MessageTraceMumP2P:
-		log.Printf("MumP2P trace received but handler not implemented")
+		Log.Debugf("MumP2P trace received but handler not implemented")
 	case protobuf.ResponseType_Unknown:
 	default:
-		log.Println("Unknown response command:", resp.GetCommand())
+		Log.Warnf("Unknown response command: %v", resp.GetCommand())
 	}
 }
 
+// Tracker carries the optional run-wide state used by
+// HandleResponseWithTracking. A nil Tracker or nil field disables the
+// corresponding feature.
+type Tracker struct {
+	// Dedupe drops messages whose payload hash was already seen from any IP.
+	Dedupe *HashSet
+	// Duplicates counts, per receiving IP, the messages dropped by Dedupe.
+	Duplicates *KeyCounter
+	// Sequences records the publisher sequence numbers embedded by multi-publish.
+	Sequences *SequenceTracker
+	// Trace configures the trace handlers.
+	Trace *TraceOptions
+	// Metrics counts received messages and decode errors.
+	Metrics *Metrics
+	// DumpDir, if set, receives each message payload in a file named by its sha256.
+	DumpDir string
+	// TagRecords prefixes each data line with a DATA column so that it can
+	// share a channel with trace lines (see TraceOptions.TagRecords).
+	TagRecords bool
+	// Hops, if set, is filled from the trace events of each IP and appends a
+	// ReceivedFromColumn to every data line ("-" when no trace named the peer
+	// before the message arrived).
+	Hops *HopIndex
+}
+
+// Record type column values written when TagRecords is set.
+const (
+	RecordData  = "DATA"
+	RecordTrace = "TRACE"
+)
+
+// HandleResponseWithTracking counts a received message and forwards its data
+// and trace records to the output channels, applying the optional features
+// configured in t.
 func HandleResponseWithTracking(ip string, resp *protobuf.Response, counter *int32,
-	writeData bool, dataCh chan<- string, writeTrace bool, traceCh chan<- string) {
+	writeData bool, dataCh chan<- string, writeTrace bool, traceCh chan<- string, t *Tracker) {
+
+	if t == nil {
+		t = &Tracker{}
+	}
 
 	switch resp.GetCommand() {
 	case protobuf.ResponseType_Message:
 		var p2pMessage P2PMessage
 		if err := json.Unmarshal(resp.GetData(), &p2pMessage); err != nil {
-			log.Printf("Error unmarshalling message: %v", err)
+			Log.Warnf("Error unmarshalling message: %v", err)
+			t.Metrics.DecodeError()
 			return
 		}
-		_ = atomic.AddInt32(counter, 1)
 
 		hash := sha256.Sum256(p2pMessage.Message)
 		hexHashString := hex.EncodeToString(hash[:])
 
-		parts := strings.Split(string(p2pMessage.Message), "-")
-		if len(parts) > 0 && writeData {
-			publisher := parts[0]
+		if t.Dedupe != nil && !t.Dedupe.Add(hexHashString) {
+			if t.Duplicates != nil {
+				t.Duplicates.Inc(ip)
+			}
+			return
+		}
+		_ = atomic.AddInt32(counter, 1)
+		t.Metrics.MessageReceived(len(p2pMessage.Message))
+		if t.DumpDir != "" {
+			if err := DumpPayload(t.DumpDir, hexHashString, p2pMessage.Message); err != nil {
+				Log.Errorf("dump payload: %v", err)
+			}
+		}
+
+		if checked, ok := CheckPayloadSum(p2pMessage.Message); checked {
+			t.Metrics.IntegrityChecked(ok)
+			if !ok {
+				Log.Warnf("[%s] integrity check failed: message %s body does not match its embedded sha256", ip, hexHashString)
+			}
+		}
+
+		publisher, seq, hasSeq := messagePublisher(p2pMessage.Message)
+		if hasSeq && t.Sequences != nil {
+			t.Sequences.Observe(publisher, seq)
+		}
+		if writeData {
 			dataToSend := fmt.Sprintf("%s\t%s\t%d\t%s", ip, publisher, len(p2pMessage.Message), hexHashString)
+			if t.Hops != nil {
+				dataToSend += "\t" + receivedFrom(t.Hops, ip, p2pMessage.MessageID)
+			}
+			if t.TagRecords {
+				dataToSend = RecordData + "\t" + dataToSend
+			}
 			dataCh <- dataToSend
 		}
 
 	case protobuf.ResponseType_MessageTraceMumP2P:
-		HandleOptimumP2PTrace(resp.GetData(), writeTrace, traceCh)
+		if rec, ok := HandleOptimumP2PTrace(resp.GetData(), writeTrace, traceCh, t.Trace); ok {
+			t.Hops.Observe(ip, rec)
+		}
 	case protobuf.ResponseType_MessageTraceGossipSub:
-		HandleGossipSubTrace(resp.GetData(), writeTrace, traceCh)
+		if rec, ok := HandleGossipSubTrace(resp.GetData(), writeTrace, traceCh, t.Trace); ok {
+			t.Hops.Observe(ip, rec)
+		}
 	default:
-		log.Println("Unknown response command:", resp.GetCommand())
+		Log.Warnf("Unknown response command: %v", resp.GetCommand())
+	}
+}
+
+// receivedFrom looks up the peer ip received a message from. Trace events
+// carry base58 message IDs; the ID in the message may be raw or already
+// encoded, so both forms are tried.
+func receivedFrom(hops *HopIndex, ip, msgID string) string {
+	if msgID == "" {
+		return "-"
+	}
+	if p, ok := hops.Lookup(ip, base58.Encode([]byte(msgID))); ok {
+		return p
 	}
+	if p, ok := hops.Lookup(ip, msgID); ok {
+		return p
+	}
+	return "-"
+}
+
+// messagePublisher returns the publisher of msg and, if present, its sequence
+// number. Payloads without a PayloadHeader (older multi-publish builds) carry
+// the publisher before the first "-".
+func messagePublisher(msg []byte) (publisher string, seq uint64, hasSeq bool) {
+	if h, _, ok := ParsePayload(msg); ok {
+		return h.Publisher, h.Seq, true
+	}
+	seq, rest, hasSeq := ParseSequence(msg)
+	publisher, _, _ = strings.Cut(string(rest), "-")
+	return publisher, seq, hasSeq
 }
 
-func HandleGossipSubTrace(data []byte, writeTrace bool, traceCh chan<- string) {
+// DumpPayload writes payload to dir/<hash> unless that file already exists.
+// The payload is written to a temporary file and renamed into place, so
+// concurrent writers of the same hash never leave a partial file.
+func DumpPayload(dir, hash string, payload []byte) error {
+	path := filepath.Join(dir, hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	f, err := os.CreateTemp(dir, hash+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(payload); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// TraceOptions configures the trace handlers. A nil *TraceOptions emits
+// every event as TSV.
+type TraceOptions struct {
+	// Topic, when non-empty, drops events whose decoded topic differs.
+	Topic string
+	// KeepUntopiced emits events that carry no topic (e.g. NEW_SHARD) even
+	// when Topic is set.
+	KeepUntopiced bool
+	// Format selects the output encoding: TraceFormatTSV (default) or TraceFormatJSON.
+	Format string
+	// HumanTime writes timestamps as RFC3339 instead of raw nanoseconds.
+	HumanTime bool
+	// Shards, if non-nil, aggregates OptimumP2P shard events per message.
+	Shards *ShardStats
+	// Metrics, if non-nil, counts emitted events and decode errors.
+	Metrics *Metrics
+	// TagRecords prefixes each written line with a TRACE column so that it
+	// can share a channel with data lines (see Tracker.TagRecords).
+	TagRecords bool
+}
+
+const (
+	TraceFormatTSV  = "tsv"
+	TraceFormatJSON = "json"
+)
+
+// TraceRecord is a decoded trace event as written to the trace output.
+// Peer and message IDs are base58 encoded.
+type TraceRecord struct {
+	Type         string `json:"type"`
+	PeerID       string `json:"peerID"`
+	ReceivedFrom string `json:"receivedFrom"`
+	MessageID    string `json:"messageID"`
+	Topic        string `json:"topic"`
+	Timestamp    int64  `json:"timestamp"`
+}
+
+// FormatRecord renders rec as a TSV row (the default) or a JSON object. With
+// HumanTime set the timestamp is written as RFC3339 with nanoseconds.
+func (o *TraceOptions) FormatRecord(rec TraceRecord) string {
+	ts := strconv.FormatInt(rec.Timestamp, 10)
+	if o != nil && o.HumanTime {
+		ts = time.Unix(0, rec.Timestamp).UTC().Format(time.RFC3339Nano)
+	}
+
+	if o != nil && o.Format == TraceFormatJSON {
+		var v any = rec
+		if o.HumanTime {
+			v = struct {
+				TraceRecord
+				Timestamp string `json:"timestamp"`
+			}{rec, ts}
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			Log.Errorf("marshal trace record: %v", err)
+			return ""
+		}
+		return string(b)
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s",
+		rec.Type, rec.PeerID, rec.ReceivedFrom, rec.MessageID, rec.Topic, ts)
+}
+
+func emitTrace(rec TraceRecord, writeTrace bool, traceCh chan<- string, opts *TraceOptions) {
+	opts.metrics().TraceEvent(rec.Topic, rec.Type)
+	line := opts.FormatRecord(rec)
+	if writeTrace {
+		if opts != nil && opts.TagRecords {
+			line = RecordTrace + "\t" + line
+		}
+		traceCh <- line
+	} else {
+		// Trace rows are output, not diagnostics: they go to stdout
+		// unprefixed, whatever the log level, so they can be piped.
+		fmt.Println(line)
+	}
+}
+
+func (o *TraceOptions) metrics() *Metrics {
+	if o == nil {
+		return nil
+	}
+	return o.Metrics
+}
+
+// Allow reports whether an event with the given topic should be emitted.
+func (o *TraceOptions) Allow(topic string) bool {
+	if o == nil || o.Topic == "" {
+		return true
+	}
+	if topic == "" {
+		return o.KeepUntopiced
+	}
+	return topic == o.Topic
+}
+
+// HandleGossipSubTrace decodes a GossipSub trace event and emits it unless
+// opts filters it out. It returns the decoded record, filtered or not, and
+// false if data could not be decoded.
+func HandleGossipSubTrace(data []byte, writeTrace bool, traceCh chan<- string, opts *TraceOptions) (TraceRecord, bool) {
 	evt := &pubsubpb.TraceEvent{}
 	if err := proto.Unmarshal(data, evt); err != nil {
-		fmt.Printf("[TRACE] GossipSub decode error: %v raw=%dB head=%s\n",
+		Log.Warnf("[TRACE] GossipSub decode error: %v raw=%dB head=%s",
 			err, len(data), HeadHex(data, 64))
-		return
+		opts.metrics().DecodeError()
+		return TraceRecord{}, false
 	}
 
 	typeStr := optsub.TraceEvent_Type_name[int32(evt.GetType())]
@@ -137,12 +558,12 @@ func HandleGossipSubTrace(data []byte, writeTrace bool, traceCh chan<- string) {
 	if evt.DeliverMessage != nil {
 		rawBytes := []byte(evt.DeliverMessage.MessageID)
 		msgID = base58.Encode(rawBytes)
-		topic = string(*evt.DeliverMessage.Topic)
+		topic = evt.DeliverMessage.GetTopic()
 	}
 	if evt.PublishMessage != nil {
 		rawBytes := []byte(evt.PublishMessage.MessageID)
 		msgID = base58.Encode(rawBytes)
-		topic = string(*evt.PublishMessage.Topic)
+		topic = evt.PublishMessage.GetTopic()
 	}
 
 	timestamp := int64(0)
@@ -150,19 +571,44 @@ func HandleGossipSubTrace(data []byte, writeTrace bool, traceCh chan<- string) {
 		timestamp = *evt.Timestamp
 	}
 
-	if writeTrace {
-		dataToSend := fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%d", typeStr, peerID, recvID, msgID, topic, timestamp)
-		traceCh <- dataToSend
-	} else {
-		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%d\n", typeStr, peerID, recvID, msgID, topic, timestamp)
+	rec := TraceRecord{
+		Type:         typeStr,
+		PeerID:       peerID.String(),
+		ReceivedFrom: recvID,
+		MessageID:    msgID,
+		Topic:        topic,
+		Timestamp:    timestamp,
+	}
+	if !opts.Allow(topic) {
+		return rec, true
+	}
+
+	emitTrace(rec, writeTrace, traceCh, opts)
+	return rec, true
+}
+
+// shardContainer returns whichever shard payload the event carries, if any.
+func shardContainer(evt *optsub.TraceEvent) *optsub.TraceEvent_ShardContainer {
+	switch {
+	case evt.NewShard != nil:
+		return evt.NewShard
+	case evt.DuplicateShard != nil:
+		return evt.DuplicateShard
+	case evt.UnhelpfulShard != nil:
+		return evt.UnhelpfulShard
+	case evt.UnnecessaryShard != nil:
+		return evt.UnnecessaryShard
 	}
+	return nil
 }
 
-func HandleOptimumP2PTrace(data []byte, writeTrace bool, traceCh chan<- string) {
+// HandleOptimumP2PTrace is the OptimumP2P counterpart of HandleGossipSubTrace.
+func HandleOptimumP2PTrace(data []byte, writeTrace bool, traceCh chan<- string, opts *TraceOptions) (TraceRecord, bool) {
 	evt := &optsub.TraceEvent{}
 	if err := proto.Unmarshal(data, evt); err != nil {
-		fmt.Printf("[TRACE] mump2p decode error: %v\n", err)
-		return
+		Log.Warnf("[TRACE] mump2p decode error: %v", err)
+		opts.metrics().DecodeError()
+		return TraceRecord{}, false
 	}
 
 	typeStr := optsub.TraceEvent_Type_name[int32(evt.GetType())]
@@ -178,8 +624,9 @@ func HandleOptimumP2PTrace(data []byte, writeTrace bool, traceCh chan<- string)
 		rawBytes := []byte(evt.DeliverMessage.ReceivedFrom)
 		recvID = base58.Encode(rawBytes)
 	}
-	if evt.NewShard != nil && evt.NewShard.ReceivedFrom != nil {
-		rawBytes := []byte(evt.NewShard.ReceivedFrom)
+	shard := shardContainer(evt)
+	if shard != nil && shard.ReceivedFrom != nil {
+		rawBytes := []byte(shard.ReceivedFrom)
 		recvID = base58.Encode(rawBytes)
 	}
 
@@ -188,15 +635,15 @@ func HandleOptimumP2PTrace(data []byte, writeTrace bool, traceCh chan<- string)
 	if evt.DeliverMessage != nil {
 		rawBytes := []byte(evt.DeliverMessage.MessageID)
 		msgID = base58.Encode(rawBytes)
-		topic = string(*evt.DeliverMessage.Topic)
+		topic = evt.DeliverMessage.GetTopic()
 	}
 	if evt.PublishMessage != nil {
 		rawBytes := []byte(evt.PublishMessage.MessageID)
 		msgID = base58.Encode(rawBytes)
-		topic = string(*evt.PublishMessage.Topic)
+		topic = evt.PublishMessage.GetTopic()
 	}
-	if evt.NewShard != nil {
-		rawBytes := []byte(evt.NewShard.MessageID)
+	if shard != nil {
+		rawBytes := []byte(shard.MessageID)
 		msgID = base58.Encode(rawBytes)
 	}
 
@@ -205,48 +652,209 @@ func HandleOptimumP2PTrace(data []byte, writeTrace bool, traceCh chan<- string)
 		timestamp = *evt.Timestamp
 	}
 
-	if writeTrace {
-		dataToSend := fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%d", typeStr, peerID, recvID, msgID, topic, timestamp)
-		traceCh <- dataToSend
-	} else {
-		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%d\n", typeStr, peerID, recvID, msgID, topic, timestamp)
+	rec := TraceRecord{
+		Type:         typeStr,
+		PeerID:       peerID.String(),
+		ReceivedFrom: recvID,
+		MessageID:    msgID,
+		Topic:        topic,
+		Timestamp:    timestamp,
+	}
+	if !opts.Allow(topic) {
+		return rec, true
 	}
+	if opts != nil && opts.Shards != nil {
+		opts.Shards.Observe(msgID, evt.GetType())
+	}
+
+	emitTrace(rec, writeTrace, traceCh, opts)
+	return rec, true
 }
 
-func WriteToFile(ctx context.Context, dataCh <-chan string, done chan<- bool, filename string, header string) {
-	file, err := os.Create(filename)
+// FileWriterOptions tunes how WriteToFileWithOptions batches writes.
+type FileWriterOptions struct {
+	// FlushInterval is how often buffered lines are flushed to disk.
+	FlushInterval time.Duration
+	// FlushBytes flushes early once this many bytes are buffered.
+	FlushBytes int
+	// RotateBytes starts a new segment once the current one reaches this
+	// size. Segments after the first are named with an incrementing suffix
+	// before the extension (out.tsv, out.1.tsv, out.2.tsv, ...). Zero disables
+	// rotation. The limit applies to uncompressed bytes.
+	RotateBytes int64
+	// Gzip compresses the output. It is implied by a ".gz" filename, and
+	// ".gz" is appended to filenames that lack it.
+	Gzip bool
+}
+
+var DefaultFileWriterOptions = FileWriterOptions{
+	FlushInterval: 500 * time.Millisecond,
+	FlushBytes:    64 * 1024,
+}
+
+// segmentWriter is a buffered file writer that rolls over to a new segment,
+// re-writing the header, once the configured size is reached.
+type segmentWriter struct {
+	filename string
+	header   string
+	opts     FileWriterOptions
+
+	segment int
+	written int64
+	file    *os.File
+	gz      *gzip.Writer
+	writer  *bufio.Writer
+}
+
+func segmentName(filename string, segment int) string {
+	if segment == 0 {
+		return filename
+	}
+	base, gz := strings.CutSuffix(filename, ".gz")
+	ext := filepath.Ext(base)
+	name := fmt.Sprintf("%s.%d%s", strings.TrimSuffix(base, ext), segment, ext)
+	if gz {
+		name += ".gz"
+	}
+	return name
+}
+
+func (w *segmentWriter) open() error {
+	file, err := os.Create(segmentName(w.filename, w.segment))
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer file.Close()
+	w.file = file
+	w.written = 0
+	var out io.Writer = file
+	if w.opts.Gzip {
+		w.gz = gzip.NewWriter(file)
+		out = w.gz
+	}
+	w.writer = bufio.NewWriterSize(out, max(w.opts.FlushBytes, 4096))
+	if w.header != "" {
+		return w.writeLine(w.header)
+	}
+	return nil
+}
+
+// flush pushes buffered lines (and any pending compressed data) to the file.
+func (w *segmentWriter) flush() error {
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	if w.gz != nil {
+		return w.gz.Flush()
+	}
+	return nil
+}
+
+func (w *segmentWriter) close() error {
+	err := w.writer.Flush()
+	if w.gz != nil {
+		if gerr := w.gz.Close(); err == nil {
+			err = gerr
+		}
+	}
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (w *segmentWriter) writeLine(line string) error {
+	n, err := w.writer.WriteString(line + "\n")
+	w.written += int64(n)
+	return err
+}
+
+// write appends line, rotating first if the current segment is full.
+func (w *segmentWriter) write(line string) error {
+	if w.opts.RotateBytes > 0 && w.written >= w.opts.RotateBytes {
+		if err := w.close(); err != nil {
+			Log.Errorf("Close error: %v", err)
+		}
+		w.segment++
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	if err := w.writeLine(line); err != nil {
+		return err
+	}
+	if w.opts.FlushBytes > 0 && w.writer.Buffered() >= w.opts.FlushBytes {
+		return w.flush()
+	}
+	return nil
+}
+
+// WriteToFile writes every line received on dataCh to filename using
+// DefaultFileWriterOptions. See WriteToFileWithOptions.
+func WriteToFile(ctx context.Context, dataCh <-chan string, done chan<- bool, filename string, header string) {
+	WriteToFileWithOptions(ctx, dataCh, done, filename, header, DefaultFileWriterOptions)
+}
+
+// WriteToFileWithOptions writes header (if non-empty) and then every line
+// received on dataCh to filename. Lines are buffered and flushed every
+// FlushInterval, once FlushBytes are pending, when ctx is canceled and when
+// dataCh is closed. It keeps draining dataCh after cancellation so producers
+// never block, and closes done once dataCh is closed and everything is on disk.
+//
+// The function is the only writer of filename; any number of goroutines may
+// send on dataCh concurrently. The caller closes dataCh exactly once, after
+// every producer has returned, and then waits on done. Write errors are
+// logged without stopping the drain, so a producer can only block if dataCh
+// is never closed.
+func WriteToFileWithOptions(ctx context.Context, dataCh <-chan string, done chan<- bool, filename string, header string, opts FileWriterOptions) {
 	defer close(done)
 
-	writer := bufio.NewWriter(file)
-	defer writer.Flush()
+	if strings.HasSuffix(filename, ".gz") {
+		opts.Gzip = true
+	} else if opts.Gzip {
+		filename += ".gz"
+	}
 
-	if header != "" {
-		_, err := writer.WriteString(header + "\n")
-		if err != nil {
-			log.Printf("Write error: %v", err)
+	w := &segmentWriter{filename: filename, header: header, opts: opts}
+	if err := w.open(); err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		if err := w.close(); err != nil {
+			Log.Errorf("Close error: %v", err)
+		}
+	}()
+
+	flush := func() {
+		if err := w.flush(); err != nil {
+			Log.Errorf("Flush error: %v", err)
 		}
 	}
 
+	var tick <-chan time.Time
+	if opts.FlushInterval > 0 {
+		ticker := time.NewTicker(opts.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
 	ctxDone := ctx.Done()
 	for {
 		select {
 		case <-ctxDone:
 			// Continue draining channel so producers don't block on shutdown.
 			ctxDone = nil
+			flush()
+		case <-tick:
+			flush()
 		case data, ok := <-dataCh:
 			if !ok {
-				fmt.Println("All data flushed to disk")
+				flush()
+				Log.Infof("All data flushed to disk")
 				return
 			}
 
-			_, err := writer.WriteString(data + "\n")
-			writer.Flush()
-			if err != nil {
-				log.Printf("Write error: %v", err)
+			if err := w.write(data); err != nil {
+				Log.Errorf("Write error: %v", err)
 			}
 		}
 	}
@@ -0,0 +1,225 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestWriteToFileConcurrentCancel sends from many goroutines while ctx is
+// canceled partway through, and checks that every line the writer accepted
+// ends up in the file. Run with -race.
+func TestWriteToFileConcurrentCancel(t *testing.T) {
+	const (
+		producers = 16
+		perWorker = 500
+		header    = "worker\tline"
+	)
+	name := filepath.Join(t.TempDir(), "out.tsv")
+	opts := FileWriterOptions{FlushInterval: time.Millisecond, FlushBytes: 256}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dataCh := make(chan string, 8)
+	done := make(chan bool)
+	go WriteToFileWithOptions(ctx, dataCh, done, name, header, opts)
+
+	var sent atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < producers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				dataCh <- fmt.Sprintf("%d\t%d", w, i)
+				if sent.Add(1) == producers*perWorker/2 {
+					cancel()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(dataCh)
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("writer did not finish after dataCh was closed")
+	}
+
+	content, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if lines[0] != header {
+		t.Fatalf("first line = %q, want header %q", lines[0], header)
+	}
+	got := make(map[string]bool, len(lines)-1)
+	for _, l := range lines[1:] {
+		if got[l] {
+			t.Errorf("line %q written twice", l)
+		}
+		got[l] = true
+	}
+	if len(got) != int(sent.Load()) {
+		t.Errorf("wrote %d lines, %d were sent", len(got), sent.Load())
+	}
+	for w := 0; w < producers; w++ {
+		for i := 0; i < perWorker; i++ {
+			if l := fmt.Sprintf("%d\t%d", w, i); !got[l] {
+				t.Errorf("line %q missing", l)
+			}
+		}
+	}
+}
+
+func TestSegmentName(t *testing.T) {
+	tests := []struct {
+		filename string
+		segment  int
+		want     string
+	}{
+		{"out.tsv", 0, "out.tsv"},
+		{"out.tsv", 1, "out.1.tsv"},
+		{"out.tsv.gz", 2, "out.2.tsv.gz"},
+		{"out", 3, "out.3"},
+		{"dir.d/out", 1, "dir.d/out.1"},
+		{"out.gz", 1, "out.1.gz"},
+	}
+	for _, tt := range tests {
+		if got := segmentName(tt.filename, tt.segment); got != tt.want {
+			t.Errorf("segmentName(%q, %d) = %q, want %q", tt.filename, tt.segment, got, tt.want)
+		}
+	}
+}
+
+func TestExpandEndpoint(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  []string
+		count int
+		err   string
+	}{
+		{entry: "10.0.0.1:33212", want: []string{"10.0.0.1:33212"}},
+		{entry: "10.0.0.254-10.0.1.1:9", want: []string{"10.0.0.254:9", "10.0.0.255:9", "10.0.1.0:9", "10.0.1.1:9"}},
+		{entry: "10.0.0.5-10.0.0.5:9", want: []string{"10.0.0.5:9"}},
+		{entry: "10.0.0.5-10.0.0.1:9", err: "end must not precede start"},
+		{entry: "[fd00::1-::2]:9", err: "end must not precede start"},
+		{entry: "10.0.0.1-fd00::1", err: "end must not precede start"},
+		{entry: "10.0.0.x-10.0.0.2:9", err: "invalid range start"},
+		{entry: "10.0.0.1-10.0.0:9", err: "invalid range end"},
+		{entry: "10.0.1.3/30:9", want: []string{"10.0.1.0:9", "10.0.1.1:9", "10.0.1.2:9", "10.0.1.3:9"}},
+		{entry: "[fd00::/127]:9", want: []string{"[fd00::]:9", "[fd00::1]:9"}},
+		{entry: "10.0.0.0/33:9", err: "invalid CIDR"},
+		{entry: "10.0.0.0/16:9", count: maxExpandedEndpoints},
+		{entry: "10.0.0.0/15:9", err: "expands to more than"},
+		{entry: "[fd00::/64]:9", err: "expands to more than"},
+		{entry: "10.0.0.0-10.0.255.255:9", count: maxExpandedEndpoints},
+		{entry: "10.0.0.0-10.1.0.0:9", err: "expands to more than"},
+		{entry: "[::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:9", err: "expands to more than"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			got, err := expandEndpoint(tt.entry, "")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expandEndpoint(%q) error = %v, want one containing %q", tt.entry, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expandEndpoint(%q): %v", tt.entry, err)
+			}
+			if tt.count > 0 {
+				if len(got) != tt.count {
+					t.Errorf("expandEndpoint(%q) returned %d endpoints, want %d", tt.entry, len(got), tt.count)
+				}
+				return
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("expandEndpoint(%q) = %v, want %v", tt.entry, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadIPsFromFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "ips.txt")
+	content := "# fleet\n\n10.0.0.1:1\n10.0.0.2-10.0.0.3:2\n  10.0.1.0/31:4000  \n"
+	if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadIPsFromFile(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "10.0.0.1:1 10.0.0.2:2 10.0.0.3:2 10.0.1.0:4000 10.0.1.1:4000"
+	if strings.Join(got, " ") != want {
+		t.Errorf("ReadIPsFromFile = %v, want %s", got, want)
+	}
+}
+
+func TestNormalizeEndpoint(t *testing.T) {
+	tests := []struct {
+		entry, defaultPort string
+		want               string
+		err                string
+	}{
+		{"10.0.0.1:33212", "", "10.0.0.1:33212", ""},
+		{"10.0.0.1", "33212", "10.0.0.1:33212", ""},
+		{"node.example.com", "1", "node.example.com:1", ""},
+		{"[::1]:33212", "", "[::1]:33212", ""},
+		{"[::1]", "1", "[::1]:1", ""},
+		{"::1", "1", "[::1]:1", ""},
+		{"10.0.0.1", "", "", "missing port"},
+		{"10.0.0.1:0", "", "", "bad port"},
+		{"10.0.0.1:65536", "", "", "bad port"},
+		{"10.0.0.1:http", "", "", "bad port"},
+		{":33212", "", "", "bad host"},
+		{"[::1", "1", "", "missing ']'"},
+		{"[::1]x", "1", "", "unexpected"},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeEndpoint(tt.entry, tt.defaultPort)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("NormalizeEndpoint(%q, %q) error = %v, want one containing %q", tt.entry, tt.defaultPort, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("NormalizeEndpoint(%q, %q) = %q, %v; want %q", tt.entry, tt.defaultPort, got, err, tt.want)
+		}
+	}
+}
+
+func TestReadIPsFromFileDefaultPort(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "ips.txt")
+	if err := os.WriteFile(name, []byte("10.0.0.1\n10.0.0.2:4000\n10.0.1.0/31\n[::1]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadIPsFromFile(name, "33212")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "10.0.0.1:33212 10.0.0.2:4000 10.0.1.0:33212 10.0.1.1:33212 [::1]:33212"
+	if strings.Join(got, " ") != want {
+		t.Errorf("ReadIPsFromFile = %v, want %s", got, want)
+	}
+
+	bad := filepath.Join(dir, "bad.txt")
+	if err := os.WriteFile(bad, []byte("# fleet\n10.0.0.1:1\n10.0.0.2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadIPsFromFile(bad, ""); err == nil || !strings.Contains(err.Error(), bad+":3:") {
+		t.Errorf("ReadIPsFromFile(missing port) error = %v, want one for line 3", err)
+	}
+}
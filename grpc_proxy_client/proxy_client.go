@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
@@ -12,15 +15,25 @@ import (
 	"log"
 	"math"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	protobuf "proxy_client/grpc"
 
+	"golang.org/x/net/websocket"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -30,71 +43,135 @@ const (
 	defaultThreshold = 0.1
 	defaultMsgCount  = 5
 	defaultDelay     = 2 * time.Second
+	initialBackoff   = 500 * time.Millisecond
 )
 
 var (
 	topic         = flag.String("topic", defaultTopic, "topic name")
+	topicsFlag    = flag.String("topics", "", "comma-separated topic names to subscribe to; overrides -topic, publishing cycles through them")
 	threshold     = flag.Float64("threshold", defaultThreshold, "delivery threshold (0.0 to 1.0)")
 	subscribeOnly = flag.Bool("subscribeOnly", false, "only subscribe and receive messages (no publishing)")
 	messageCount  = flag.Int("count", defaultMsgCount, "number of messages to publish")
 	messageDelay  = flag.Duration("delay", defaultDelay, "delay between message publishing")
+	payloadFile   = flag.String("file", "", "publish the contents of this file as each message instead of random text")
+	payloadStdin  = flag.Bool("stdin", false, "publish one message per line read from stdin, up to -count lines")
+	once          = flag.String("once", "", "publish this one message to -topic via REST and exit, without subscribing")
+	generator     = flag.String("gen", "words", "message generator used without -file or -stdin: words | random | counter")
+	genSize       = flag.Int("size", 64, "message size in bytes for -gen random")
 
-	proxyAddr = flag.String("proxy", "localhost:50051", "proxy gRPC server address")
-	restAddr  = flag.String("rest", "http://localhost:8081", "proxy REST API base URL")
+	grpcAddr  = flag.String("grpc-addr", proxyGRPC, "proxy gRPC server address")
+	restAddr  = flag.String("rest-addr", proxyREST, "proxy REST API base URL")
+	transport = flag.String("transport", "grpc", "how messages are received: grpc | ws")
+	wsURL     = flag.String("ws-url", "", "WebSocket URL used with -transport ws (default: -rest-addr with a ws:// or wss:// scheme and path /api/v1/ws)")
+
+	dialTimeout = flag.Duration("dial-timeout", 10*time.Second, "give up on a gRPC connection attempt that is not ready within this long (0 waits for the OS TCP timeout)")
+	maxBackoff  = flag.Duration("max-backoff", 30*time.Second, "maximum delay between gRPC stream reconnect attempts")
+
+	// These mirror the TLS flags of the P2P client tools (grpc_p2p_client/shared).
+	useTLS      = flag.Bool("tls", false, "connect to the proxy gRPC server with TLS instead of plaintext")
+	tlsCAFile   = flag.String("tls-ca", "", "PEM CA bundle used to verify the server (default: system roots)")
+	tlsCertFile = flag.String("tls-cert", "", "PEM client certificate for mutual TLS (requires -tls-key)")
+	tlsKeyFile  = flag.String("tls-key", "", "PEM client private key for mutual TLS (requires -tls-cert)")
 
 	words = []string{"hello", "ping", "update", "broadcast", "status", "message", "event", "data", "note"}
 )
 
+func init() {
+	// -proxy and -rest are the original names of -grpc-addr and -rest-addr.
+	flag.StringVar(grpcAddr, "proxy", proxyGRPC, "alias for -grpc-addr")
+	flag.StringVar(restAddr, "rest", proxyREST, "alias for -rest-addr")
+}
+
 func main() {
 	flag.Parse()
+	if *threshold < 0 || *threshold > 1 {
+		log.Fatalf("-threshold must be within [0.0, 1.0], got %v", *threshold)
+	}
+	if *messageCount < 0 {
+		log.Fatalf("-count must be >= 0, got %d", *messageCount)
+	}
+	if *messageDelay < 0 {
+		log.Fatalf("-delay must be >= 0, got %v", *messageDelay)
+	}
+	if *transport != "grpc" && *transport != "ws" {
+		log.Fatalf("-transport must be grpc or ws, got %q", *transport)
+	}
+	creds, err := transportCredentials()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	gen, err := newMessageGenerator(*generator, *genSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *generator != "words" && (*payloadFile != "" || *payloadStdin) {
+		log.Fatal("-gen cannot be combined with -file or -stdin")
+	}
+	nextPayload, err := payloadSource(*payloadFile, *payloadStdin, gen)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	topics := splitTopics(*topicsFlag)
+	if len(topics) == 0 {
+		topics = []string{*topic}
+	}
 
 	clientID := generateClientID()
-	log.Printf("[INFO] Client ID: %s | Topic: %s | Threshold: %.2f", clientID, *topic, *threshold)
+	if *once != "" {
+		if *subscribeOnly || *payloadFile != "" || *payloadStdin || len(topics) > 1 {
+			log.Fatal("-once cannot be combined with -subscribeOnly, -file, -stdin or several -topics")
+		}
+		if err := publishMessage(*restAddr, clientID, topics[0], *once); err != nil {
+			log.Fatalf("publish failed: %v", err)
+		}
+		log.Printf("[PUBLISH] Topic: %s | Message: %s", topics[0], *once)
+		return
+	}
+	log.Printf("[INFO] Client ID: %s | Topics: %s | Threshold: %.2f", clientID, strings.Join(topics, ", "), *threshold)
 
-	// Subscribe via REST
-	if err := subscribe(clientID, *topic, *threshold); err != nil {
-		log.Fatalf("subscribe error: %v", err)
+	// Subscribe via REST, once per topic
+	for _, t := range topics {
+		if err := subscribe(*restAddr, clientID, t, *threshold); err != nil {
+			log.Fatalf("subscribe error for topic %q: %v", t, err)
+		}
 	}
 
-	// Connect to gRPC stream with flow control settings
-	conn, err := grpc.NewClient(*proxyAddr,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithInitialWindowSize(1024*1024*1024),     // 1GB per-stream receive window
-		grpc.WithInitialConnWindowSize(1024*1024*1024), // 1GB connection-level receive window
+	// gRPC dial options with flow control settings
+	dialOpts := []grpc.DialOption{
+		creds,
+		grpc.WithInitialWindowSize(1024 * 1024 * 1024),     // 1GB per-stream receive window
+		grpc.WithInitialConnWindowSize(1024 * 1024 * 1024), // 1GB connection-level receive window
 		grpc.WithDefaultCallOptions(
 			grpc.MaxCallRecvMsgSize(math.MaxInt),
 			grpc.MaxCallSendMsgSize(math.MaxInt),
 		),
-	)
-	if err != nil {
-		log.Fatalf("gRPC connection failed: %v", err)
 	}
-	defer conn.Close()
 
-	client := protobuf.NewProxyStreamClient(conn)
-	stream, err := client.ClientStream(context.Background())
-	if err != nil {
-		log.Fatalf("stream open failed: %v", err)
+	report := newDeliveryReport()
+	gate := newStreamGate()
+	receive := func() (bool, error) {
+		return receiveStream(*grpcAddr, dialOpts, clientID, report, gate)
 	}
-
-	if err := stream.Send(&protobuf.ProxyMessage{ClientId: clientID}); err != nil {
-		log.Fatalf("client ID send failed: %v", err)
+	if *transport == "ws" {
+		target, err := webSocketURL(*wsURL, *restAddr, clientID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsCfg, err := tlsConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		receive = func() (bool, error) {
+			return receiveWebSocket(target, tlsCfg, report, gate)
+		}
 	}
-
-	// Handle incoming messages
+	// streamDone receives why the stream ended for good: nil if the server
+	// closed it, otherwise the error that ruled out reconnecting.
+	streamDone := make(chan error, 1)
 	go func() {
-		for {
-			resp, err := stream.Recv()
-			if err == io.EOF {
-				log.Println("[CLOSED] gRPC stream closed by server")
-				return
-			}
-			if err != nil {
-				log.Printf("[ERROR] stream receive: %v", err)
-				return
-			}
-			log.Printf("[RECEIVED] Topic: %s | Message: %s", resp.Topic, string(resp.Message))
-		}
+		streamDone <- runStream(*transport, receive, gate)
 	}()
 
 	// Trap SIGINT
@@ -103,58 +180,482 @@ func main() {
 	go func() {
 		<-c
 		log.Println("[INTERRUPTED] shutting down...")
+		report.print(*threshold)
 		os.Exit(0)
 	}()
 
 	if *subscribeOnly {
-		select {}
+		// Only the stream ending stops a subscriber, and it is never expected to.
+		err := <-streamDone
+		report.print(*threshold)
+		exitStreamEnded(err)
 	}
 
-	// Message publishing loop
+	// Message publishing loop; pauses while the stream is reconnecting
 	for i := 0; i < *messageCount; i++ {
-		msg := generateRandomMessage()
-		log.Printf("[PUBLISH] Message: %s", msg)
-		if err := publishMessage(clientID, *topic, msg); err != nil {
+		if !gate.wait() {
+			log.Println("[CLOSED] stream closed, stopping publishing")
+			break
+		}
+		msg, ok := nextPayload()
+		if !ok {
+			log.Printf("[INFO] input exhausted after %d messages", i)
+			break
+		}
+		t := topics[i%len(topics)]
+		log.Printf("[PUBLISH] Topic: %s | Message: %s", t, msg)
+		// Record before sending so a fast echo cannot beat the bookkeeping.
+		report.published(t, msg)
+		if err := publishMessage(*restAddr, clientID, t, msg); err != nil {
+			report.unpublished(t, msg)
 			log.Printf("[ERROR] publish failed: %v", err)
 		}
 		time.Sleep(*messageDelay)
 	}
 
-	time.Sleep(3 * time.Second)
+	// Wait for the last echoes, unless the stream is already gone.
+	select {
+	case err := <-streamDone:
+		report.print(*threshold)
+		exitStreamEnded(err)
+	case <-time.After(3 * time.Second):
+	}
+	report.print(*threshold)
+}
+
+// exitStreamEnded logs why the stream ended and exits non-zero. The stream
+// only ends on its own when the server closes it or rejects the client, and
+// neither is expected while the client is still running.
+func exitStreamEnded(err error) {
+	if err != nil {
+		log.Printf("[ERROR] stream ended: %v", err)
+	} else {
+		log.Println("[ERROR] stream ended: closed by server")
+	}
+	os.Exit(1)
+}
+
+// deliveryReport matches the messages this client publishes against those it
+// receives back on the stream. Payloads are counted per topic as a multiset,
+// so repeated payloads are matched one for one.
+type deliveryReport struct {
+	mu            sync.Mutex
+	outstanding   map[string]int
+	sent          int
+	delivered     int
+	totalReceived int
+}
+
+func newDeliveryReport() *deliveryReport {
+	return &deliveryReport{outstanding: make(map[string]int)}
+}
+
+func reportKey(topic, msg string) string { return topic + "\x00" + msg }
+
+func (r *deliveryReport) published(topic, msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent++
+	r.outstanding[reportKey(topic, msg)]++
+}
+
+// unpublished reverts published for a message whose publish request failed.
+func (r *deliveryReport) unpublished(topic, msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := reportKey(topic, msg)
+	if r.outstanding[k] > 0 {
+		r.sent--
+		r.outstanding[k]--
+	}
+}
+
+func (r *deliveryReport) received(topic, msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.totalReceived++
+	k := reportKey(topic, msg)
+	if r.outstanding[k] > 0 {
+		r.outstanding[k]--
+		r.delivered++
+	}
+}
+
+func (r *deliveryReport) print(threshold float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ratio := 0.0
+	if r.sent > 0 {
+		ratio = float64(r.delivered) / float64(r.sent)
+	}
+	log.Printf("[REPORT] Published: %d | Received back: %d | Delivery ratio: %.2f | Threshold: %.2f | Total received: %d",
+		r.sent, r.delivered, ratio, threshold, r.totalReceived)
+}
+
+// runStream keeps a message stream to the proxy open by calling receive,
+// which returns a nil error once the server ends the stream and reports
+// whether the stream was opened. After any other error it calls receive again,
+// backing off exponentially up to -max-backoff, unless the error is one that
+// a retry cannot fix. gate is up while a stream is open. runStream returns,
+// and closes gate for good, only when the server ends the stream (nil) or
+// after such an error (the error).
+func runStream(name string, receive func() (bool, error), gate *streamGate) error {
+	backoff := initialBackoff
+	for {
+		opened, err := receive()
+		gate.setDown()
+		if err == nil {
+			log.Printf("[CLOSED] %s stream closed by server", name)
+			gate.close()
+			return nil
+		}
+		if permanentStreamError(err) {
+			log.Printf("[ERROR] stream: %v; not reconnecting", err)
+			gate.close()
+			return err
+		}
+		if opened {
+			backoff = initialBackoff
+		}
+		log.Printf("[ERROR] stream: %v; reconnecting in %v", err, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, *maxBackoff)
+	}
+}
+
+// permanentStreamError reports whether err is a gRPC status that the proxy
+// would return again on every reconnect, such as a rejected client ID or
+// missing credentials.
+func permanentStreamError(err error) bool {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.Unauthenticated, codes.PermissionDenied, codes.Unimplemented:
+		return true
+	}
+	return false
+}
+
+// receiveStream dials the proxy, registers clientID and receives until the
+// stream ends. It returns a nil error on EOF and reports whether the stream
+// was opened.
+func receiveStream(addr string, dialOpts []grpc.DialOption, clientID string, report *deliveryReport, gate *streamGate) (bool, error) {
+	conn, err := grpc.NewClient(addr, dialOpts...)
+	if err != nil {
+		return false, fmt.Errorf("gRPC connection failed: %w", err)
+	}
+	defer conn.Close()
+	if err := waitForReady(conn, *dialTimeout); err != nil {
+		return false, err
+	}
+
+	client := protobuf.NewProxyStreamClient(conn)
+	stream, err := client.ClientStream(context.Background())
+	if err != nil {
+		return false, fmt.Errorf("stream open failed: %w", err)
+	}
+	if err := stream.Send(&protobuf.ProxyMessage{ClientId: clientID}); err != nil {
+		return false, fmt.Errorf("client ID send failed: %w", err)
+	}
+	log.Printf("[CONNECTED] gRPC stream open to %s", addr)
+	gate.setUp()
+
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return true, fmt.Errorf("stream receive: %w", err)
+		}
+		logReceived(report, resp.Topic, string(resp.Message))
+	}
+}
+
+func logReceived(report *deliveryReport, topic, msg string) {
+	report.received(topic, msg)
+	log.Printf("[RECEIVED] Topic: %s | Message: %s", topic, msg)
+}
+
+// webSocketURL returns override if set, otherwise the WebSocket endpoint on
+// the REST host: http becomes ws and https becomes wss, with path /api/v1/ws.
+// The client ID is added as the client_id query parameter either way.
+func webSocketURL(override, restBase, clientID string) (string, error) {
+	raw := override
+	if raw == "" {
+		raw = strings.TrimSuffix(restBase, "/") + "/api/v1/ws"
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("WebSocket URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return "", fmt.Errorf("WebSocket URL %q: scheme must be ws, wss, http or https", raw)
+	}
+	q := u.Query()
+	q.Set("client_id", clientID)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// wsMessage is a message frame sent by the proxy WebSocket endpoint.
+type wsMessage struct {
+	Topic   string `json:"topic"`
+	Message string `json:"message"`
+}
+
+// receiveWebSocket connects to target and receives until the server closes
+// the connection, mirroring receiveStream. Frames are decoded as wsMessage
+// JSON; anything else is logged as a message without a topic. tlsCfg, if set,
+// is used for wss:// URLs.
+func receiveWebSocket(target string, tlsCfg *tls.Config, report *deliveryReport, gate *streamGate) (bool, error) {
+	cfg, err := websocket.NewConfig(target, "http://localhost/")
+	if err != nil {
+		return false, fmt.Errorf("WebSocket config: %w", err)
+	}
+	cfg.TlsConfig = tlsCfg
+	cfg.Dialer = &net.Dialer{Timeout: *dialTimeout}
+	ws, err := websocket.DialConfig(cfg)
+	if err != nil {
+		return false, fmt.Errorf("WebSocket connection failed: %w", err)
+	}
+	defer ws.Close()
+	log.Printf("[CONNECTED] WebSocket open to %s", target)
+	gate.setUp()
+
+	for {
+		var frame []byte
+		err := websocket.Message.Receive(ws, &frame)
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return true, fmt.Errorf("WebSocket receive: %w", err)
+		}
+		var m wsMessage
+		if err := json.Unmarshal(frame, &m); err != nil {
+			m = wsMessage{Message: string(frame)}
+		}
+		logReceived(report, m.Topic, m.Message)
+	}
+}
+
+// waitForReady connects conn and waits up to timeout for it to become ready,
+// mirroring shared.WaitForReady in the P2P client tools.
+func waitForReady(conn *grpc.ClientConn, timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn.Connect()
+	for {
+		state := conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.Shutdown:
+			return fmt.Errorf("connection to %s shut down", conn.Target())
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("%s not reachable within %v (last state %s)", conn.Target(), timeout, state)
+		}
+	}
+}
+
+// streamGate lets the publishing loop wait until the stream is open.
+type streamGate struct {
+	mu     sync.Mutex
+	up     bool
+	closed bool
+	ready  chan struct{} // closed when up or closed becomes true
+}
+
+func newStreamGate() *streamGate {
+	return &streamGate{ready: make(chan struct{})}
+}
+
+func (g *streamGate) setUp() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.up && !g.closed {
+		g.up = true
+		close(g.ready)
+	}
+}
+
+func (g *streamGate) setDown() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.up && !g.closed {
+		g.up = false
+		g.ready = make(chan struct{})
+	}
 }
 
-// subscribe registers the client with the Proxy via REST API
-func subscribe(clientID, topic string, threshold float64) error {
+// close marks the stream as finished, releasing any waiters.
+func (g *streamGate) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.closed {
+		g.closed = true
+		if !g.up {
+			close(g.ready)
+		}
+	}
+}
+
+// wait blocks until the stream is open and reports false if it has closed instead.
+func (g *streamGate) wait() bool {
+	g.mu.Lock()
+	ready := g.ready
+	g.mu.Unlock()
+	<-ready
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return !g.closed
+}
+
+// subscribe registers the client with the Proxy via the REST API at baseURL
+func subscribe(baseURL, clientID, topic string, threshold float64) error {
 	body := map[string]interface{}{
 		"client_id": clientID,
 		"topic":     topic,
 		"threshold": threshold,
 	}
-	data, _ := json.Marshal(body)
-	resp, err := http.Post(*restAddr+"/api/v1/subscribe", "application/json", bytes.NewReader(data))
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	io.Copy(io.Discard, resp.Body)
-	return nil
+	_, err := postJSON(strings.TrimSuffix(baseURL, "/")+"/api/v1/subscribe", body)
+	return err
 }
 
-// publishMessage sends a REST request to publish a message
-func publishMessage(clientID, topic, msg string) error {
+// publishMessage sends a REST request to baseURL to publish a message
+func publishMessage(baseURL, clientID, topic, msg string) error {
 	body := map[string]interface{}{
 		"client_id": clientID,
 		"topic":     topic,
 		"message":   msg,
 	}
-	data, _ := json.Marshal(body)
-	resp, err := http.Post(*restAddr+"/api/v1/publish", "application/json", bytes.NewReader(data))
+	_, err := postJSON(strings.TrimSuffix(baseURL, "/")+"/api/v1/publish", body)
+	return err
+}
+
+// postJSON POSTs body as JSON to url and returns the response body. Any
+// non-2xx status is returned as an error carrying the status and response text.
+func postJSON(url string, body interface{}) ([]byte, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
-	io.Copy(io.Discard, resp.Body)
-	return nil
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response from %s: %w", url, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return respBody, fmt.Errorf("%s: %s: %s", url, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return respBody, nil
+}
+
+// splitTopics parses a comma-separated topic list, dropping empty entries
+func splitTopics(s string) []string {
+	var out []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// payloadSource returns a function yielding the messages to publish: the
+// whole of file on every call, successive stdin lines until EOF, or the
+// messages of gen when neither is set.
+func payloadSource(file string, stdin bool, gen MessageGenerator) (func() (string, bool), error) {
+	switch {
+	case file != "" && stdin:
+		return nil, fmt.Errorf("-file and -stdin are mutually exclusive")
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read -file: %w", err)
+		}
+		return func() (string, bool) { return string(data), true }, nil
+	case stdin:
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+		return func() (string, bool) {
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					log.Printf("[ERROR] read stdin: %v", err)
+				}
+				return "", false
+			}
+			return scanner.Text(), true
+		}, nil
+	}
+	return func() (string, bool) { return gen.Next(), true }, nil
+}
+
+// MessageGenerator produces the messages published when neither -file nor
+// -stdin is set.
+type MessageGenerator interface {
+	Next() string
+}
+
+// newMessageGenerator returns the -gen generator called name. size is only
+// used by the random generator.
+func newMessageGenerator(name string, size int) (MessageGenerator, error) {
+	switch name {
+	case "words":
+		return wordGenerator{}, nil
+	case "random":
+		if size < 1 {
+			return nil, fmt.Errorf("-size must be >= 1, got %d", size)
+		}
+		return randomGenerator{size: size}, nil
+	case "counter":
+		return &counterGenerator{}, nil
+	}
+	return nil, fmt.Errorf("-gen must be words, random or counter, got %q", name)
+}
+
+// wordGenerator yields a random word and the current time, e.g. "ping @ 15:04:05".
+type wordGenerator struct{}
+
+func (wordGenerator) Next() string { return generateRandomMessage() }
+
+// randomGenerator yields size random hex characters, for size-based tests.
+// Hex keeps the message valid text in the JSON publish request.
+type randomGenerator struct {
+	size int
+}
+
+func (g randomGenerator) Next() string {
+	b := make([]byte, (g.size+1)/2)
+	_, _ = crand.Read(b)
+	return hex.EncodeToString(b)[:g.size]
+}
+
+// counterGenerator yields "0", "1", "2", ..., so the order in which messages
+// come back can be checked.
+type counterGenerator struct {
+	n int
+}
+
+func (g *counterGenerator) Next() string {
+	msg := strconv.Itoa(g.n)
+	g.n++
+	return msg
 }
 
 // generateClientID returns a random client identifier
@@ -168,3 +669,51 @@ func generateClientID() string {
 func generateRandomMessage() string {
 	return fmt.Sprintf("%s @ %s", words[rand.Intn(len(words))], time.Now().Format("15:04:05"))
 }
+
+// transportCredentials returns the grpc.NewClient credentials option selected
+// by the TLS flags, defaulting to insecure when -tls is absent.
+func transportCredentials() (grpc.DialOption, error) {
+	cfg, err := tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return grpc.WithTransportCredentials(insecure.NewCredentials()), nil
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(cfg)), nil
+}
+
+// tlsConfig builds the client TLS configuration from the TLS flags. It
+// returns nil without -tls.
+func tlsConfig() (*tls.Config, error) {
+	if !*useTLS {
+		if *tlsCAFile != "" || *tlsCertFile != "" || *tlsKeyFile != "" {
+			return nil, fmt.Errorf("-tls-ca, -tls-cert and -tls-key require -tls")
+		}
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if *tlsCAFile != "" {
+		pem, err := os.ReadFile(*tlsCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read -tls-ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("-tls-ca %s: no PEM certificates found", *tlsCAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if (*tlsCertFile == "") != (*tlsKeyFile == "") {
+		return nil, fmt.Errorf("-tls-cert and -tls-key must be set together")
+	}
+	if *tlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDeliveryReport(t *testing.T) {
+	r := newDeliveryReport()
+	r.published("t", "a")
+	r.published("t", "a")
+	r.published("t", "b")
+	r.published("u", "c")
+	r.unpublished("t", "b") // its publish request failed
+	r.unpublished("t", "x") // never published: ignored
+
+	r.received("t", "a")
+	r.received("t", "a")
+	r.received("t", "a") // a third copy is not a delivery
+	r.received("t", "b") // unpublished, so not a delivery
+	r.received("t", "c") // published to another topic
+
+	if r.sent != 3 || r.delivered != 2 || r.totalReceived != 5 {
+		t.Errorf("sent=%d delivered=%d totalReceived=%d, want 3, 2, 5", r.sent, r.delivered, r.totalReceived)
+	}
+	if n := r.outstanding[reportKey("u", "c")]; n != 1 {
+		t.Errorf("outstanding u/c = %d, want 1", n)
+	}
+
+	// A message that already came back cannot be unpublished.
+	r.published("t", "d")
+	r.received("t", "d")
+	r.unpublished("t", "d")
+	if r.sent != 4 || r.delivered != 3 {
+		t.Errorf("after d: sent=%d delivered=%d, want 4, 3", r.sent, r.delivered)
+	}
+}
+
+// waitResult runs g.wait in a goroutine and returns a channel with its result.
+func waitResult(g *streamGate) <-chan bool {
+	ch := make(chan bool, 1)
+	go func() { ch <- g.wait() }()
+	return ch
+}
+
+func expectBlocked(t *testing.T, ch <-chan bool) {
+	t.Helper()
+	select {
+	case v := <-ch:
+		t.Fatalf("wait returned %v while the stream was down", v)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func expectResult(t *testing.T, ch <-chan bool, want bool) {
+	t.Helper()
+	select {
+	case v := <-ch:
+		if v != want {
+			t.Fatalf("wait = %v, want %v", v, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait did not return")
+	}
+}
+
+func TestStreamGate(t *testing.T) {
+	g := newStreamGate()
+	ch := waitResult(g)
+	expectBlocked(t, ch)
+	g.setUp()
+	expectResult(t, ch, true)
+	expectResult(t, waitResult(g), true)
+	g.setUp() // already up
+
+	g.setDown()
+	ch = waitResult(g)
+	expectBlocked(t, ch)
+	g.setDown() // already down
+	g.setUp()
+	expectResult(t, ch, true)
+
+	g.setDown()
+	ch = waitResult(g)
+	expectBlocked(t, ch)
+	g.close()
+	expectResult(t, ch, false)
+	expectResult(t, waitResult(g), false)
+
+	// Nothing reopens a closed gate.
+	g.setUp()
+	g.setDown()
+	g.close()
+	expectResult(t, waitResult(g), false)
+}
+
+func TestStreamGateCloseWhileUp(t *testing.T) {
+	g := newStreamGate()
+	g.setUp()
+	g.close()
+	expectResult(t, waitResult(g), false)
+	g.setDown()
+	expectResult(t, waitResult(g), false)
+}
+
+// TestStreamGateConcurrent flaps the gate while many goroutines wait on it,
+// then closes it; every waiter must return. Run with -race.
+func TestStreamGateConcurrent(t *testing.T) {
+	g := newStreamGate()
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for g.wait() {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		g.setUp()
+		g.setDown()
+	}
+	g.close()
+	close(stop)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiters still blocked after close")
+	}
+}
+
+func TestRunStreamReconnects(t *testing.T) {
+	saved := *maxBackoff
+	*maxBackoff = initialBackoff
+	defer func() { *maxBackoff = saved }()
+
+	g := newStreamGate()
+	unavailable := status.Error(codes.Unavailable, "proxy restarting")
+	results := []struct {
+		opened bool
+		err    error
+	}{
+		{false, unavailable},
+		{true, unavailable},
+		{true, nil},
+	}
+	calls := 0
+	receive := func() (bool, error) {
+		r := results[calls]
+		calls++
+		if r.opened {
+			g.setUp()
+		}
+		return r.opened, r.err
+	}
+	if err := runStream("test", receive, g); err != nil {
+		t.Fatalf("runStream = %v, want nil once the server closes the stream", err)
+	}
+	if calls != len(results) {
+		t.Errorf("receive called %d times, want %d", calls, len(results))
+	}
+	expectResult(t, waitResult(g), false)
+}
+
+func TestWebSocketURL(t *testing.T) {
+	tests := []struct {
+		override, restBase string
+		want               string
+		err                string
+	}{
+		{restBase: "http://localhost:8081", want: "ws://localhost:8081/api/v1/ws?client_id=c+1"},
+		{restBase: "https://proxy.example.com/", want: "wss://proxy.example.com/api/v1/ws?client_id=c+1"},
+		{restBase: "http://10.0.0.1:8081/base/", want: "ws://10.0.0.1:8081/base/api/v1/ws?client_id=c+1"},
+		{override: "ws://other:9000/stream", restBase: "http://ignored", want: "ws://other:9000/stream?client_id=c+1"},
+		{override: "wss://other/stream?client_id=old&x=1", want: "wss://other/stream?client_id=c+1&x=1"},
+		{override: "https://other/ws", want: "wss://other/ws?client_id=c+1"},
+		{restBase: "localhost:8081", err: "scheme must be"},
+		{override: "ftp://other/ws", err: "scheme must be"},
+		{override: "ws://[::1", err: "WebSocket URL"},
+	}
+	for _, tt := range tests {
+		got, err := webSocketURL(tt.override, tt.restBase, "c 1")
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("webSocketURL(%q, %q) error = %v, want one containing %q", tt.override, tt.restBase, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("webSocketURL(%q, %q) = %q, %v; want %q", tt.override, tt.restBase, got, err, tt.want)
+		}
+	}
+}
+
+func TestRunStreamStops(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{"EOF", nil, false},
+		{"InvalidArgument", status.Error(codes.InvalidArgument, "bad client ID"), true},
+		{"Unauthenticated", status.Error(codes.Unauthenticated, "no token"), true},
+		{"PermissionDenied", status.Error(codes.PermissionDenied, "denied"), true},
+		{"Unimplemented", status.Error(codes.Unimplemented, "no ClientStream"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newStreamGate()
+			calls := 0
+			receive := func() (bool, error) {
+				calls++
+				g.setUp()
+				return true, tt.err
+			}
+			err := runStream("test", receive, g)
+			if tt.wantErr && !errors.Is(err, tt.err) {
+				t.Errorf("runStream = %v, want %v", err, tt.err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("runStream = %v, want nil", err)
+			}
+			if calls != 1 {
+				t.Errorf("receive called %d times, want 1", calls)
+			}
+			expectResult(t, waitResult(g), false)
+		})
+	}
+}
+
+func TestPermanentStreamError(t *testing.T) {
+	for _, c := range []codes.Code{codes.Unavailable, codes.Internal, codes.DeadlineExceeded, codes.ResourceExhausted} {
+		if permanentStreamError(status.Error(c, "")) {
+			t.Errorf("%v treated as permanent", c)
+		}
+	}
+	if permanentStreamError(errors.New("gRPC connection failed")) {
+		t.Error("a non-status error treated as permanent")
+	}
+}
+
+func TestNewMessageGenerator(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		err  string
+	}{
+		{"words", 0, ""},
+		{"random", 1, ""},
+		{"random", 0, "-size must be >= 1"},
+		{"random", -5, "-size must be >= 1"},
+		{"counter", 0, ""},
+		{"", 0, "-gen must be words, random or counter"},
+		{"Random", 8, "-gen must be words, random or counter"},
+	}
+	for _, tt := range tests {
+		gen, err := newMessageGenerator(tt.name, tt.size)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("newMessageGenerator(%q, %d) error = %v, want one containing %q", tt.name, tt.size, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || gen == nil {
+			t.Errorf("newMessageGenerator(%q, %d) = %v, %v", tt.name, tt.size, gen, err)
+		}
+	}
+}
+
+func TestRandomGeneratorSize(t *testing.T) {
+	for _, size := range []int{1, 2, 63, 64, 65, 1024} {
+		gen, err := newMessageGenerator("random", size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := gen.Next()
+		if len(msg) != size {
+			t.Errorf("size %d: message length %d", size, len(msg))
+		}
+		if strings.Trim(msg, "0123456789abcdef") != "" {
+			t.Errorf("size %d: message %q is not hex", size, msg)
+		}
+		if size >= 64 && gen.Next() == msg {
+			t.Errorf("size %d: two messages are equal", size)
+		}
+	}
+}
+
+func TestCounterGenerator(t *testing.T) {
+	gen, err := newMessageGenerator("counter", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 12; i++ {
+		if got := gen.Next(); got != strconv.Itoa(i) {
+			t.Fatalf("message %d = %q", i, got)
+		}
+	}
+}
+
+func TestWordGenerator(t *testing.T) {
+	gen, err := newMessageGenerator("words", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if strings.TrimSpace(gen.Next()) == "" {
+			t.Fatal("empty message")
+		}
+	}
+}
@@ -2,15 +2,24 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"hash/crc64"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -23,7 +32,19 @@ type IdentityInfo struct {
 	ID  peer.ID // this is needed only to simplify integration with some testing tools
 }
 
-func genIdentity() (crypto.PrivKey, error) {
+// genIdentity generates an Ed25519 identity from the CSPRNG, or
+// deterministically from seed when it is non-nil.
+func genIdentity(seed []byte) (crypto.PrivKey, error) {
+	if seed != nil {
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("seed must be %d bytes, got %d", ed25519.SeedSize, len(seed))
+		}
+		pk, err := crypto.UnmarshalEd25519PrivateKey(ed25519.NewKeyFromSeed(seed))
+		if err != nil {
+			return nil, fmt.Errorf("derive ed25519 identity from seed: %w", err)
+		}
+		return pk, nil
+	}
 	pk, _, err := crypto.GenerateEd25519Key(rand.Reader)
 	if err != nil {
 		return nil, fmt.Errorf("generate ed25519 identity: %w", err)
@@ -31,6 +52,29 @@ func genIdentity() (crypto.PrivKey, error) {
 	return pk, nil
 }
 
+// parseSeed returns the 32-byte key seed selected by -seed (hex) or
+// -mnemonic, or nil when neither is set. A mnemonic is any phrase; its seed
+// is the SHA-256 of its whitespace-normalized words.
+func parseSeed(seedHex, mnemonic string) ([]byte, error) {
+	switch {
+	case seedHex != "" && mnemonic != "":
+		return nil, errors.New("-seed and -mnemonic are mutually exclusive")
+	case seedHex != "":
+		seed, err := hex.DecodeString(strings.TrimPrefix(seedHex, "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("decode -seed: %w", err)
+		}
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("-seed must be %d bytes (%d hex characters), got %d bytes", ed25519.SeedSize, 2*ed25519.SeedSize, len(seed))
+		}
+		return seed, nil
+	case mnemonic != "":
+		sum := sha256.Sum256([]byte(strings.Join(strings.Fields(mnemonic), " ")))
+		return sum[:], nil
+	}
+	return nil, nil
+}
+
 // loadFromFile loads the data from the given file and verifies the checksum. It returns the data without the checksum
 func loadFromFile(path string) (data []byte, err error) {
 	if _, err = os.Stat(path); os.IsNotExist(err) {
@@ -142,21 +186,55 @@ func IdentityInfoFromDir(dir string) (*IdentityInfo, error) {
 	return &info, nil
 }
 
-// ensureIdentity generates an identity key file in given directory.
-func ensureIdentity(dir string) (crypto.PrivKey, error) {
+// backupIdentity renames an existing key file in dir to a timestamped backup
+// and returns the backup path, or "" if there was nothing to back up.
+func backupIdentity(dir string) (string, error) {
+	path := filepath.Join(dir, keyFilename)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return "", nil
+	}
+	backup := fmt.Sprintf("%s.%s.bak", path, time.Now().Format("20060102T150405"))
+	if err := os.Rename(path, backup); err != nil {
+		return "", fmt.Errorf("back up %s: %w", path, err)
+	}
+	return backup, nil
+}
+
+// ensureIdentity generates an identity key file in given directory, from seed
+// if it is non-nil. An existing key is reused unless force is set, in which
+// case it is backed up and replaced.
+func ensureIdentity(dir string, force bool, seed []byte) (crypto.PrivKey, error) {
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return nil, fmt.Errorf("ensure that directory %s exist: %w", dir, err)
 	}
+	if force {
+		backup, err := backupIdentity(dir)
+		if err != nil {
+			return nil, err
+		}
+		if backup != "" {
+			fmt.Fprintln(os.Stderr, "Backed up existing key to", backup)
+		}
+	}
 	info, err := IdentityInfoFromDir(dir)
 	if err == nil {
 		pk, err := crypto.UnmarshalPrivateKey(info.Key)
 		if err != nil {
 			return nil, fmt.Errorf("unmarshal privkey: %w", err)
 		}
+		if seed != nil {
+			want, err := genIdentity(seed)
+			if err != nil {
+				return nil, err
+			}
+			if !pk.Equals(want) {
+				return nil, fmt.Errorf("existing key in %s was not derived from the given seed; use -force to replace it", dir)
+			}
+		}
 		return pk, nil
 	}
 	if errors.Is(err, os.ErrNotExist) {
-		key, err := genIdentity()
+		key, err := genIdentity(seed)
 		if err != nil {
 			return nil, err
 		}
@@ -183,20 +261,175 @@ func ensureIdentity(dir string) (crypto.PrivKey, error) {
 	return nil, fmt.Errorf("read key from disk: %w", err)
 }
 
+// identitySummary is what main reports about an identity, as text or with -json.
+type identitySummary struct {
+	Dir       string `json:"dir"`
+	PeerID    string `json:"peerID"`
+	PublicKey string `json:"publicKey"` // base64 of the protobuf-marshaled public key
+	Multiaddr string `json:"multiaddr"`
+}
+
+func summarize(dir string, key crypto.PrivKey) (identitySummary, error) {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return identitySummary{}, fmt.Errorf("derive peer ID: %w", err)
+	}
+	pub, err := crypto.MarshalPublicKey(key.GetPublic())
+	if err != nil {
+		return identitySummary{}, fmt.Errorf("marshal public key: %w", err)
+	}
+	return identitySummary{
+		Dir:       dir,
+		PeerID:    id.String(),
+		PublicKey: base64.StdEncoding.EncodeToString(pub),
+		Multiaddr: "/ip4/0.0.0.0/tcp/0/p2p/" + id.String(),
+	}, nil
+}
+
+// inspectIdentity loads the key file at path (or path/p2p.key if path is a
+// directory), verifies its checksum and checks that the stored ID matches the
+// peer ID derived from the private key.
+func inspectIdentity(path string) (identitySummary, error) {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		path = filepath.Join(path, keyFilename)
+	}
+	data, err := loadFromFile(path)
+	if err != nil {
+		return identitySummary{}, fmt.Errorf("read file %s: %w", path, err)
+	}
+	var info IdentityInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return identitySummary{}, fmt.Errorf("unmarshal file content from %s: %w", path, err)
+	}
+	key, err := crypto.UnmarshalPrivateKey(info.Key)
+	if err != nil {
+		return identitySummary{}, fmt.Errorf("unmarshal privkey: %w", err)
+	}
+	summary, err := summarize(filepath.Dir(path), key)
+	if err != nil {
+		return identitySummary{}, err
+	}
+	if info.ID.String() != summary.PeerID {
+		return summary, fmt.Errorf("stored ID %s does not match derived peer ID %s", info.ID, summary.PeerID)
+	}
+	return summary, nil
+}
+
+func printSummary(summary identitySummary, asJSON bool) {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(summary); err != nil {
+			fmt.Println("unable to encode identity", err)
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Println("Peer ID:", summary.PeerID)
+	fmt.Println("Public Key:", summary.PublicKey)
+	fmt.Println("Multiaddr:", summary.Multiaddr)
+}
+
+// ensureIdentities runs ensureIdentity for out/0 … out/count-1. With a seed,
+// identity i is derived from SHA-256(seed || i) so every directory gets a
+// distinct but reproducible key.
+func ensureIdentities(out string, count int, force bool, seed []byte) ([]identitySummary, error) {
+	summaries := make([]identitySummary, 0, count)
+	for i := 0; i < count; i++ {
+		dir := filepath.Join(out, strconv.Itoa(i))
+		var dirSeed []byte
+		if seed != nil {
+			h := sha256.New()
+			h.Write(seed)
+			_ = binary.Write(h, binary.BigEndian, uint32(i))
+			dirSeed = h.Sum(nil)
+		}
+		key, err := ensureIdentity(dir, force, dirSeed)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", dir, err)
+		}
+		summary, err := summarize(dir, key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", dir, err)
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// printTable prints the directory to peer ID mapping of a -count run, or a
+// JSON array of summaries with -json.
+func printTable(summaries []identitySummary, asJSON bool) {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(summaries); err != nil {
+			fmt.Println("unable to encode identities", err)
+			os.Exit(1)
+		}
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DIR\tPEER ID")
+	for _, s := range summaries {
+		fmt.Fprintf(w, "%s\t%s\n", s.Dir, s.PeerID)
+	}
+	_ = w.Flush()
+}
+
 func main() {
-	dir := "../identity"
-	_ = os.MkdirAll(dir, 0o755)
+	dir := flag.String("out", "./identity", "directory to write "+keyFilename+" to (created if missing)")
+	force := flag.Bool("force", false, "regenerate the key even if "+keyFilename+" exists, backing up the old file first")
+	asJSON := flag.Bool("json", false, "print the identity as a JSON object")
+	seedHex := flag.String("seed", "", "derive the key deterministically from this 32-byte hex seed")
+	mnemonic := flag.String("mnemonic", "", "derive the key deterministically from this phrase: the seed is the SHA-256 of its space-separated words (not BIP-39 derivation)")
+	count := flag.Int("count", 0, "generate this many identities into numbered subdirectories of -out (0 generates one directly in -out)")
+	inspect := flag.String("inspect", "", "validate an existing key file (or directory containing "+keyFilename+") instead of generating one")
+	flag.Parse()
+
+	if *inspect != "" {
+		summary, err := inspectIdentity(*inspect)
+		if err != nil {
+			fmt.Println("invalid identity:", err)
+			os.Exit(1)
+		}
+		printSummary(summary, *asJSON)
+		if !*asJSON {
+			fmt.Println("Checksum OK, stored ID matches private key")
+		}
+		return
+	}
 
-	key, err := ensureIdentity(dir)
+	seed, err := parseSeed(*seedHex, *mnemonic)
 	if err != nil {
-		fmt.Println("unable to ensure identity", err)
+		fmt.Println("invalid seed:", err)
+		os.Exit(1)
 	}
 
-	// Print peer ID
-	id, err := peer.IDFromPrivateKey(key)
+	if *count < 0 {
+		fmt.Println("-count must be >= 0")
+		os.Exit(1)
+	}
+	if *count > 0 {
+		summaries, err := ensureIdentities(*dir, *count, *force, seed)
+		if err != nil {
+			fmt.Println("unable to ensure identities", err)
+			os.Exit(1)
+		}
+		printTable(summaries, *asJSON)
+		return
+	}
+
+	key, err := ensureIdentity(*dir, *force, seed)
 	if err != nil {
-		fmt.Println("failed to derive peer ID", err)
+		fmt.Println("unable to ensure identity", err)
+		os.Exit(1)
 	}
 
-	fmt.Println("Peer ID:", id.String())
+	summary, err := summarize(*dir, key)
+	if err != nil {
+		fmt.Println("unable to describe identity", err)
+		os.Exit(1)
+	}
+	printSummary(summary, *asJSON)
 }
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	testSeedHex = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	// testPeerID is the peer ID of the Ed25519 key whose seed is testSeedHex.
+	testPeerID = "12D3KooWA4Xop1JaT3MHxwYMkCepYsv4iPVopMXwCz5iHYdBfeSB"
+)
+
+func peerIDOf(t *testing.T, key crypto.PrivKey) string {
+	t.Helper()
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id.String()
+}
+
+func TestGenIdentityFromSeed(t *testing.T) {
+	seed, err := parseSeed(testSeedHex, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		key, err := genIdentity(seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := peerIDOf(t, key); got != testPeerID {
+			t.Fatalf("peer ID = %s, want %s", got, testPeerID)
+		}
+	}
+
+	a, err := genIdentity(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := genIdentity(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Equals(b) {
+		t.Error("two unseeded identities are equal")
+	}
+
+	if _, err := genIdentity(seed[:16]); err == nil {
+		t.Error("genIdentity accepted a 16-byte seed")
+	}
+}
+
+func TestParseSeed(t *testing.T) {
+	phrase := sha256.Sum256([]byte("correct horse battery staple"))
+	tests := []struct {
+		name, seedHex, mnemonic string
+		want                    string // hex; empty for a nil seed
+		err                     string
+	}{
+		{name: "none"},
+		{name: "hex", seedHex: testSeedHex, want: testSeedHex},
+		{name: "0x prefix", seedHex: "0x" + testSeedHex, want: testSeedHex},
+		{name: "bad hex", seedHex: "zz", err: "decode -seed"},
+		{name: "short", seedHex: testSeedHex[:62], err: "must be 32 bytes"},
+		{name: "long", seedHex: testSeedHex + "00", err: "must be 32 bytes"},
+		{name: "both", seedHex: testSeedHex, mnemonic: "a", err: "mutually exclusive"},
+		{name: "mnemonic", mnemonic: "correct horse battery staple", want: hex.EncodeToString(phrase[:])},
+		{name: "mnemonic whitespace", mnemonic: "  correct\thorse \n battery   staple ", want: hex.EncodeToString(phrase[:])},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seed, err := parseSeed(tt.seedHex, tt.mnemonic)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("parseSeed error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(seed); got != tt.want {
+				t.Errorf("seed = %s, want %s", got, tt.want)
+			}
+			if tt.want == "" && seed != nil {
+				t.Errorf("seed = %x, want nil", seed)
+			}
+		})
+	}
+}
+
+func TestEnsureIdentitiesSeeded(t *testing.T) {
+	seed, err := parseSeed(testSeedHex, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const count = 3
+	first, err := ensureIdentities(t.TempDir(), count, false, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ensureIdentities(t.TempDir(), count, false, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for i := range first {
+		if first[i].PeerID != second[i].PeerID {
+			t.Errorf("directory %d: peer IDs %s and %s differ between runs", i, first[i].PeerID, second[i].PeerID)
+		}
+		if seen[first[i].PeerID] {
+			t.Errorf("directory %d: peer ID %s repeated", i, first[i].PeerID)
+		}
+		seen[first[i].PeerID] = true
+		if first[i].PeerID == testPeerID {
+			t.Errorf("directory %d uses the -seed key itself", i)
+		}
+
+		// Directory i is derived from SHA-256(seed || uint32(i) big-endian).
+		dirSeed := sha256.Sum256(append(append([]byte{}, seed...), 0, 0, 0, byte(i)))
+		key, err := genIdentity(dirSeed[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := peerIDOf(t, key); first[i].PeerID != want {
+			t.Errorf("directory %d: peer ID %s, want %s", i, first[i].PeerID, want)
+		}
+	}
+}
+
+func TestEnsureIdentityReuse(t *testing.T) {
+	dir := t.TempDir()
+	seed, err := parseSeed(testSeedHex, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ensureIdentity(dir, false, seed); err != nil {
+		t.Fatal(err)
+	}
+	key, err := ensureIdentity(dir, false, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := peerIDOf(t, key); got != testPeerID {
+		t.Errorf("reused peer ID = %s, want %s", got, testPeerID)
+	}
+	other, err := parseSeed("", "another phrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ensureIdentity(dir, false, other); err == nil || !strings.Contains(err.Error(), "not derived from the given seed") {
+		t.Errorf("ensureIdentity with another seed error = %v, want a seed mismatch", err)
+	}
+}
+
+func TestInspectIdentity(t *testing.T) {
+	seed, err := parseSeed(testSeedHex, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKeyFile := func(t *testing.T) (dir, path string) {
+		dir = t.TempDir()
+		if _, err := ensureIdentity(dir, false, seed); err != nil {
+			t.Fatal(err)
+		}
+		return dir, filepath.Join(dir, keyFilename)
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		dir, path := newKeyFile(t)
+		for _, p := range []string{dir, path} {
+			summary, err := inspectIdentity(p)
+			if err != nil {
+				t.Fatalf("inspectIdentity(%s): %v", p, err)
+			}
+			if summary.PeerID != testPeerID {
+				t.Errorf("inspectIdentity(%s) peer ID = %s, want %s", p, summary.PeerID, testPeerID)
+			}
+		}
+	})
+
+	t.Run("tampered checksum", func(t *testing.T) {
+		_, path := newKeyFile(t)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[0] ^= 0xff
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := inspectIdentity(path); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+			t.Errorf("inspectIdentity error = %v, want a checksum mismatch", err)
+		}
+	})
+
+	t.Run("tampered body", func(t *testing.T) {
+		_, path := newKeyFile(t)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[len(data)-2] ^= 0x01
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := inspectIdentity(path); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+			t.Errorf("inspectIdentity error = %v, want a checksum mismatch", err)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		_, path := newKeyFile(t)
+		if err := os.WriteFile(path, []byte{1, 2, 3}, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := inspectIdentity(path); err == nil || !strings.Contains(err.Error(), "too short") {
+			t.Errorf("inspectIdentity error = %v, want a too-short error", err)
+		}
+	})
+
+	t.Run("swapped ID", func(t *testing.T) {
+		_, path := newKeyFile(t)
+		info, err := IdentityInfoFromDir(filepath.Dir(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := genIdentity(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ID, err = peer.IDFromPrivateKey(other); err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Rewritten with a valid checksum, so only the ID check can catch it.
+		if err := atomicallySaveToFile(path, data); err != nil {
+			t.Fatal(err)
+		}
+		_, err = inspectIdentity(path)
+		if err == nil || !strings.Contains(err.Error(), "does not match derived peer ID") {
+			t.Errorf("inspectIdentity error = %v, want an ID mismatch", err)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		if _, err := inspectIdentity(filepath.Join(t.TempDir(), keyFilename)); err == nil {
+			t.Error("inspectIdentity accepted a missing file")
+		}
+	})
+}
+
+func TestAtomicallySaveRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), keyFilename)
+	want := []byte(`{"Key":"x"}`)
+	if err := atomicallySaveToFile(path, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("loadFromFile = %q, want %q", got, want)
+	}
+}
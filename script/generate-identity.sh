@@ -69,7 +69,7 @@ print_status "Using existing keygen script..."
 cd keygen
 
 print_status "Generating P2P keypair..."
-PEER_OUTPUT=$(go run generate_p2p_key.go)
+PEER_OUTPUT=$(go run generate_p2p_key.go -out ../identity)
 
 cd ..
 
@@ -0,0 +1,82 @@
+// Package fetch is the HTTP client shared by the network tools for querying
+// the JSON APIs of nodes and proxies.
+package fetch
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Client is the HTTP client used by JSON. Configure replaces its transport.
+var Client = &http.Client{Timeout: 5 * time.Second}
+
+// maxIdleConnsPerHost caps the keep-alive connections kept to each endpoint.
+// Every endpoint is queried a few times per refresh, so a small pool lets
+// requests reuse connections without holding many sockets open per host.
+const maxIdleConnsPerHost = 2
+
+// Configure sets the request timeout and installs a transport on
+// Client that reuses connections, capped at maxIdleConnsPerHost per
+// endpoint. If caFile is set only the PEM bundle in it is trusted, and
+// insecureSkipVerify skips certificate verification; with neither option the
+// system roots are used.
+func Configure(timeout time.Duration, caFile string, insecureSkipVerify bool) error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	transport.IdleConnTimeout = 90 * time.Second
+	Client.Timeout = timeout
+	Client.Transport = transport
+
+	if caFile == "" && !insecureSkipVerify {
+		return nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig = tlsConfig
+	return nil
+}
+
+// StatusError is returned by JSON for responses other than 200 OK.
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string { return fmt.Sprintf("HTTP %d", e.Code) }
+
+// JSON fetches url with Client and decodes the JSON body into target. Any
+// status other than 200 is a *StatusError.
+func JSON(url string, target interface{}) error {
+	resp, err := Client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{Code: resp.StatusCode}
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, target)
+}
@@ -1,14 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
-	"net/http"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+
+	"network-dashboard/fetch"
 )
 
 type NodeHealth struct {
@@ -46,6 +47,9 @@ type NodeInfo struct {
 	State     *NodeState
 	Available bool
 	Error     string
+
+	// StateError is set when health succeeded but node-state could not be fetched.
+	StateError string
 }
 
 type ProxyInfo struct {
@@ -56,44 +60,24 @@ type ProxyInfo struct {
 	Error     string
 }
 
-var httpClient = &http.Client{Timeout: 5 * time.Second}
-
-func fetchJSON(url string, target interface{}) error {
-	resp, err := httpClient.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP %d", resp.StatusCode)
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
-
-	return json.Unmarshal(body, target)
-}
-
 func fetchNodeInfo(name, baseURL string) NodeInfo {
 	info := NodeInfo{Name: name, URL: baseURL}
 
 	health := &NodeHealth{}
-	if err := fetchJSON(baseURL+"/api/v1/health", health); err != nil {
+	if err := fetch.JSON(baseURL+"/api/v1/health", health); err != nil {
 		info.Error = err.Error()
 		return info
 	}
 	info.Health = health
 
+	info.Available = true
+
 	state := &NodeState{}
-	if err := fetchJSON(baseURL+"/api/v1/node-state", state); err != nil {
-		info.Error = err.Error()
+	if err := fetch.JSON(baseURL+"/api/v1/node-state", state); err != nil {
+		info.StateError = err.Error()
 		return info
 	}
 	info.State = state
-	info.Available = true
 
 	return info
 }
@@ -102,7 +86,7 @@ func fetchProxyInfo(name, baseURL string) ProxyInfo {
 	info := ProxyInfo{Name: name, URL: baseURL}
 
 	health := &ProxyHealth{}
-	if err := fetchJSON(baseURL+"/api/v1/health", health); err != nil {
+	if err := fetch.JSON(baseURL+"/api/v1/health", health); err != nil {
 		info.Error = err.Error()
 		return info
 	}
@@ -112,10 +96,160 @@ func fetchProxyInfo(name, baseURL string) ProxyInfo {
 	return info
 }
 
-func printDashboard(nodes []NodeInfo, proxies []ProxyInfo, nodeCountries *NodeCountries) {
+// TableRow holds the display values for one proxy or node table row.
+type TableRow struct {
+	Name    string
+	Status  string
+	CPU     string
+	Memory  string
+	Disk    string
+	Peers   string
+	Topics  string
+	Country string
+	URL     string
+}
+
+func proxyRow(p ProxyInfo) TableRow {
+	r := TableRow{Name: p.Name, URL: p.URL, Status: "DOWN",
+		CPU: "N/A", Memory: "N/A", Disk: "N/A", Country: "N/A"}
+	if p.Available && p.Health != nil {
+		r.Status = p.Health.Status
+		r.CPU = p.Health.CPUUsed
+		r.Memory = p.Health.MemoryUsed
+		r.Disk = p.Health.DiskUsed
+		r.Country = p.Health.Country
+	}
+	return r
+}
+
+func nodeRow(n NodeInfo) TableRow {
+	r := TableRow{Name: n.Name, URL: n.URL, Status: "DOWN",
+		CPU: "N/A", Memory: "N/A", Disk: "N/A", Country: "N/A", Peers: "0", Topics: "0"}
+	if n.Available {
+		if n.Health != nil {
+			r.Status = n.Health.Status
+			r.CPU = n.Health.CPUUsed
+			r.Memory = n.Health.MemoryUsed
+			r.Disk = n.Health.DiskUsed
+			r.Country = n.Health.Country
+		}
+		if n.State != nil {
+			r.Peers = fmt.Sprintf("%d", len(n.State.Peers))
+			r.Topics = fmt.Sprintf("%d", len(n.State.Topics))
+		} else if n.StateError != "" {
+			r.Peers, r.Topics = "N/A", "N/A"
+		}
+	}
+	return r
+}
+
+type NetworkTotals struct {
+	Reachable    int
+	Down         int
+	UniquePeers  int
+	UniqueTopics int
+}
+
+// summarizeNodes computes network-wide totals from the fetched node state,
+// deduplicating peers by public key and topics by name.
+func summarizeNodes(nodes []NodeInfo) NetworkTotals {
+	var t NetworkTotals
+	peers := make(map[string]struct{})
+	topics := make(map[string]struct{})
+	for _, n := range nodes {
+		if !n.Available {
+			t.Down++
+			continue
+		}
+		t.Reachable++
+		if n.State == nil {
+			continue
+		}
+		for _, p := range n.State.Peers {
+			peers[p] = struct{}{}
+		}
+		for _, topic := range n.State.Topics {
+			topics[topic] = struct{}{}
+		}
+	}
+	t.UniquePeers = len(peers)
+	t.UniqueTopics = len(topics)
+	return t
+}
+
+// Status buckets reported at the top of the dashboard.
+const (
+	BucketOK       = "OK"
+	BucketDegraded = "DEGRADED"
+	BucketDown     = "DOWN"
+)
+
+// StatusBuckets maps lower-cased health statuses to a bucket.
+type StatusBuckets map[string]string
+
+const defaultStatusBuckets = "ok=OK,healthy=OK,degraded=DEGRADED,warning=DEGRADED,unhealthy=DOWN,down=DOWN"
+
+// parseStatusBuckets parses a comma-separated list of status=BUCKET pairs,
+// e.g. "ok=OK,degraded=DEGRADED".
+func parseStatusBuckets(s string) (StatusBuckets, error) {
+	b := make(StatusBuckets)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		status, bucket, ok := strings.Cut(pair, "=")
+		bucket = strings.ToUpper(strings.TrimSpace(bucket))
+		if !ok || strings.TrimSpace(status) == "" {
+			return nil, fmt.Errorf("invalid status mapping %q (want status=BUCKET)", pair)
+		}
+		if bucket != BucketOK && bucket != BucketDegraded && bucket != BucketDown {
+			return nil, fmt.Errorf("invalid bucket %q in %q (want OK, DEGRADED or DOWN)", bucket, pair)
+		}
+		b[strings.ToLower(strings.TrimSpace(status))] = bucket
+	}
+	return b, nil
+}
+
+// classify returns the bucket for an endpoint. Unreachable endpoints are
+// DOWN; a reachable endpoint whose status is not mapped is DEGRADED.
+func (b StatusBuckets) classify(available bool, status string) string {
+	if !available {
+		return BucketDown
+	}
+	if bucket, ok := b[strings.ToLower(strings.TrimSpace(status))]; ok {
+		return bucket
+	}
+	return BucketDegraded
+}
+
+// countBuckets tallies the proxies and nodes per status bucket.
+func countBuckets(nodes []NodeInfo, proxies []ProxyInfo, b StatusBuckets) map[string]int {
+	counts := make(map[string]int)
+	for _, p := range proxies {
+		status := ""
+		if p.Health != nil {
+			status = p.Health.Status
+		}
+		counts[b.classify(p.Available, status)]++
+	}
+	for _, n := range nodes {
+		status := ""
+		if n.Health != nil {
+			status = n.Health.Status
+		}
+		counts[b.classify(n.Available, status)]++
+	}
+	return counts
+}
+
+func printDashboard(nodes []NodeInfo, proxies []ProxyInfo, nodeCountries *NodeCountries, buckets StatusBuckets) {
 	fmt.Println(strings.Repeat("=", 100))
 	fmt.Printf("%-50s %s\n", "mump2p NETWORK DASHBOARD", time.Now().Format("2006-01-02 15:04:05"))
 	fmt.Println(strings.Repeat("=", 100))
+	counts := countBuckets(nodes, proxies, buckets)
+	fmt.Printf("%s: %d   %s: %d   %s: %d\n", BucketOK, counts[BucketOK],
+		BucketDegraded, counts[BucketDegraded], BucketDown, counts[BucketDown])
 	fmt.Println()
 
 	if len(proxies) > 0 {
@@ -125,17 +259,9 @@ func printDashboard(nodes []NodeInfo, proxies []ProxyInfo, nodeCountries *NodeCo
 			"Name", "Status", "CPU %", "Memory %", "Disk %", "Country", "URL")
 		fmt.Println(strings.Repeat("-", 100))
 		for _, p := range proxies {
-			status := "DOWN"
-			cpu, mem, disk, country := "N/A", "N/A", "N/A", "N/A"
-			if p.Available && p.Health != nil {
-				status = p.Health.Status
-				cpu = p.Health.CPUUsed
-				mem = p.Health.MemoryUsed
-				disk = p.Health.DiskUsed
-				country = p.Health.Country
-			}
+			r := proxyRow(p)
 			fmt.Printf("%-15s %-8s %-10s %-10s %-10s %-15s %-20s\n",
-				p.Name, status, cpu, mem, disk, country, p.URL)
+				r.Name, r.Status, r.CPU, r.Memory, r.Disk, r.Country, r.URL)
 		}
 		fmt.Println()
 	}
@@ -147,25 +273,14 @@ func printDashboard(nodes []NodeInfo, proxies []ProxyInfo, nodeCountries *NodeCo
 			"Name", "Status", "CPU %", "Memory %", "Disk %", "Peers", "Topics", "Country", "URL")
 		fmt.Println(strings.Repeat("-", 100))
 		for _, n := range nodes {
-			status := "DOWN"
-			cpu, mem, disk, country := "N/A", "N/A", "N/A", "N/A"
-			peers, topics := "0", "0"
-			if n.Available {
-				if n.Health != nil {
-					status = n.Health.Status
-					cpu = n.Health.CPUUsed
-					mem = n.Health.MemoryUsed
-					disk = n.Health.DiskUsed
-					country = n.Health.Country
-				}
-				if n.State != nil {
-					peers = fmt.Sprintf("%d", len(n.State.Peers))
-					topics = fmt.Sprintf("%d", len(n.State.Topics))
-				}
-			}
+			r := nodeRow(n)
 			fmt.Printf("%-15s %-8s %-10s %-10s %-10s %-8s %-8s %-15s %-20s\n",
-				n.Name, status, cpu, mem, disk, peers, topics, country, n.URL)
+				r.Name, r.Status, r.CPU, r.Memory, r.Disk, r.Peers, r.Topics, r.Country, r.URL)
 		}
+		fmt.Println(strings.Repeat("-", 100))
+		t := summarizeNodes(nodes)
+		fmt.Printf("Total: %d reachable, %d down, %d unique peers, %d unique topics\n",
+			t.Reachable, t.Down, t.UniquePeers, t.UniqueTopics)
 		fmt.Println()
 
 		fmt.Println("NODE DETAILS")
@@ -176,6 +291,10 @@ func printDashboard(nodes []NodeInfo, proxies []ProxyInfo, nodeCountries *NodeCo
 				continue
 			}
 			if n.State == nil {
+				if n.StateError != "" {
+					fmt.Printf("%s: state unavailable: %s\n", n.Name, n.StateError)
+					fmt.Println()
+				}
 				continue
 			}
 			fmt.Printf("%s (Peer ID: %s)\n", n.Name, n.State.PubKey)
@@ -213,89 +332,308 @@ func printDashboard(nodes []NodeInfo, proxies []ProxyInfo, nodeCountries *NodeCo
 	fmt.Println(strings.Repeat("=", 100))
 }
 
-func main() {
-	var (
-		proxyURLsFlag = flag.String("proxies", "", "Comma-separated list of proxy URLs (e.g., http://localhost:8081,http://localhost:8082)")
-		nodeURLsFlag  = flag.String("nodes", "", "Comma-separated list of node URLs (e.g., http://localhost:9091,http://localhost:9092)")
-		proxyBase     = flag.String("proxy-base", "", "IP(s) or URL(s) for remote proxies - will prepend http:// and append :8080")
-		nodeBase      = flag.String("node-base", "", "IP(s) or URL(s) for remote nodes (optional) - will prepend http:// and append :8081")
-		local         = flag.Bool("local", false, "Use localhost defaults (proxies: 8081,8082; nodes: 9091-9094)")
-	)
-	flag.Parse()
+// parsePercent parses usage values such as "45%", "45.2" or " 45 % " into a float.
+func parsePercent(s string) (float64, error) {
+	s = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "%"))
+	if s == "" {
+		return 0, fmt.Errorf("empty value")
+	}
+	return strconv.ParseFloat(s, 64)
+}
 
-	var proxies []ProxyInfo
-	var nodes []NodeInfo
+type Thresholds struct {
+	CPU    float64
+	Memory float64
+	Disk   float64
+}
+
+func (t Thresholds) enabled() bool {
+	return t.CPU > 0 || t.Memory > 0 || t.Disk > 0
+}
+
+// exceeded returns a description of every usage value above its threshold.
+// Thresholds of zero are disabled and unparseable values are ignored.
+func (t Thresholds) exceeded(cpu, mem, disk string) []string {
+	var out []string
+	check := func(label, value string, limit float64) {
+		if limit <= 0 {
+			return
+		}
+		v, err := parsePercent(value)
+		if err != nil {
+			return
+		}
+		if v > limit {
+			out = append(out, fmt.Sprintf("%s %.1f%% > %.1f%%", label, v, limit))
+		}
+	}
+	check("CPU", cpu, t.CPU)
+	check("Memory", mem, t.Memory)
+	check("Disk", disk, t.Disk)
+	return out
+}
+
+// checkThresholds prints every reachable node or proxy whose usage exceeds
+// the thresholds and reports whether any did.
+func checkThresholds(nodes []NodeInfo, proxies []ProxyInfo, t Thresholds) bool {
+	var alerts []string
+	for _, p := range proxies {
+		if !p.Available || p.Health == nil {
+			continue
+		}
+		for _, e := range t.exceeded(p.Health.CPUUsed, p.Health.MemoryUsed, p.Health.DiskUsed) {
+			alerts = append(alerts, fmt.Sprintf("%s (%s): %s", p.Name, p.URL, e))
+		}
+	}
+	for _, n := range nodes {
+		if !n.Available || n.Health == nil {
+			continue
+		}
+		for _, e := range t.exceeded(n.Health.CPUUsed, n.Health.MemoryUsed, n.Health.DiskUsed) {
+			alerts = append(alerts, fmt.Sprintf("%s (%s): %s", n.Name, n.URL, e))
+		}
+	}
+	if len(alerts) == 0 {
+		return false
+	}
+
+	fmt.Println("ALERTS")
+	fmt.Println(strings.Repeat("-", 100))
+	for _, a := range alerts {
+		fmt.Println(a)
+	}
+	fmt.Println()
+	return true
+}
 
-	if *local {
+type Endpoint struct {
+	Name string
+	URL  string
+}
+
+// resolveEndpoints turns the command-line selection into named proxy and node endpoints.
+func resolveEndpoints(local bool, proxyBase, proxyPort, proxyURLs, nodeBase, nodePort, nodeURLs string) (proxies, nodes []Endpoint) {
+	if local {
 		proxyAddrs := []string{"http://localhost:8081", "http://localhost:8082"}
 		for i, url := range proxyAddrs {
-			proxies = append(proxies, fetchProxyInfo(fmt.Sprintf("proxy-%d", i+1), url))
+			proxies = append(proxies, Endpoint{fmt.Sprintf("proxy-%d", i+1), url})
 		}
 		nodeAddrs := []string{"http://localhost:9091", "http://localhost:9092", "http://localhost:9093", "http://localhost:9094"}
 		for i, url := range nodeAddrs {
-			nodes = append(nodes, fetchNodeInfo(fmt.Sprintf("p2pnode-%d", i+1), url))
-		}
-	} else if *proxyBase != "" {
-		bases := strings.Split(*proxyBase, ",")
-		for i, base := range bases {
-			base = strings.TrimSpace(base)
-			if base == "" {
-				continue
-			}
-			if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
-				base = "http://" + base
-			}
-			url := base + ":8080"
-			proxies = append(proxies, fetchProxyInfo(fmt.Sprintf("proxy-%d", i+1), url))
+			nodes = append(nodes, Endpoint{fmt.Sprintf("p2pnode-%d", i+1), url})
 		}
-	} else if *proxyURLsFlag != "" {
-		urls := strings.Split(*proxyURLsFlag, ",")
+	} else if proxyBase != "" {
+		proxies = baseEndpoints("proxy", proxyBase, proxyPort)
+	} else if proxyURLs != "" {
+		urls := strings.Split(proxyURLs, ",")
 		for i, url := range urls {
 			url = strings.TrimSpace(url)
 			if url == "" {
 				continue
 			}
-			proxies = append(proxies, fetchProxyInfo(fmt.Sprintf("proxy-%d", i+1), url))
+			proxies = append(proxies, Endpoint{fmt.Sprintf("proxy-%d", i+1), url})
 		}
 	}
 
-	if *nodeBase != "" {
-		bases := strings.Split(*nodeBase, ",")
-		for i, base := range bases {
-			base = strings.TrimSpace(base)
-			if base == "" {
-				continue
-			}
-			if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
-				base = "http://" + base
-			}
-			url := base + ":8081"
-			nodes = append(nodes, fetchNodeInfo(fmt.Sprintf("p2pnode-%d", i+1), url))
-		}
-	} else if *nodeURLsFlag != "" {
-		urls := strings.Split(*nodeURLsFlag, ",")
+	if nodeBase != "" {
+		nodes = baseEndpoints("p2pnode", nodeBase, nodePort)
+	} else if nodeURLs != "" {
+		urls := strings.Split(nodeURLs, ",")
 		for i, url := range urls {
 			url = strings.TrimSpace(url)
 			if url == "" {
 				continue
 			}
-			nodes = append(nodes, fetchNodeInfo(fmt.Sprintf("p2pnode-%d", i+1), url))
+			nodes = append(nodes, Endpoint{fmt.Sprintf("p2pnode-%d", i+1), url})
 		}
 	}
 
-	if len(proxies) == 0 && len(nodes) == 0 {
-		fmt.Fprintf(os.Stderr, "Error: No proxies or nodes specified. Use -local, -proxy-base, or -proxies/-nodes flags.\n")
+	return proxies, nodes
+}
+
+// baseEndpoints names each comma-separated -proxy-base/-node-base entry
+// <prefix>-<n> and turns it into a URL with baseURL.
+func baseEndpoints(prefix, bases, port string) []Endpoint {
+	var out []Endpoint
+	for i, base := range strings.Split(bases, ",") {
+		base = strings.TrimSpace(base)
+		if base == "" {
+			continue
+		}
+		out = append(out, Endpoint{fmt.Sprintf("%s-%d", prefix, i+1), baseURL(base, port)})
+	}
+	return out
+}
+
+// baseURL prepends http:// to base unless it already has a scheme and appends
+// port unless the host already carries one. IPv6 literals are accepted with
+// or without brackets, e.g. ::1 becomes http://[::1]:<port>.
+func baseURL(base, port string) string {
+	scheme := "http://"
+	for _, s := range []string{"http://", "https://"} {
+		if strings.HasPrefix(base, s) {
+			scheme, base = s, strings.TrimPrefix(base, s)
+			break
+		}
+	}
+	host, path := base, ""
+	if i := strings.IndexByte(base, '/'); i >= 0 {
+		host, path = base[:i], base[i:]
+	}
+
+	switch {
+	case strings.HasPrefix(host, "["):
+		if !strings.Contains(host, "]:") {
+			host = host + ":" + port
+		}
+	case strings.Count(host, ":") > 1:
+		// An unbracketed IPv6 literal cannot carry a port.
+		host = net.JoinHostPort(host, port)
+	case !strings.Contains(host, ":"):
+		host = host + ":" + port
+	}
+	return scheme + host + path
+}
+
+// gather fetches the current state of every endpoint.
+func gather(proxyEndpoints, nodeEndpoints []Endpoint) ([]NodeInfo, []ProxyInfo, *NodeCountries) {
+	var proxies []ProxyInfo
+	for _, e := range proxyEndpoints {
+		proxies = append(proxies, fetchProxyInfo(e.Name, e.URL))
+	}
+	var nodes []NodeInfo
+	for _, e := range nodeEndpoints {
+		nodes = append(nodes, fetchNodeInfo(e.Name, e.URL))
+	}
+
+	return nodes, proxies, fetchNodeCountries(proxies)
+}
+
+// fetchNodeCountries queries node-countries from every available proxy and
+// merges the results, so one proxy being down does not hide country data.
+// When proxies disagree about a node, the first proxy listed wins. It returns
+// nil if no proxy answered.
+func fetchNodeCountries(proxies []ProxyInfo) *NodeCountries {
+	var merged *NodeCountries
+	for _, p := range proxies {
+		if !p.Available {
+			continue
+		}
+		nc := &NodeCountries{}
+		if err := fetch.JSON(p.URL+"/api/v1/node-countries", nc); err != nil {
+			continue
+		}
+		if merged == nil {
+			merged = &NodeCountries{Countries: make(map[string]string)}
+		}
+		for node, country := range nc.Countries {
+			if _, ok := merged.Countries[node]; !ok {
+				merged.Countries[node] = country
+			}
+		}
+	}
+	if merged != nil {
+		merged.Count = len(merged.Countries)
+	}
+	return merged
+}
+
+func main() {
+	var (
+		proxyURLsFlag = flag.String("proxies", "", "Comma-separated list of proxy URLs (e.g., http://localhost:8081,http://localhost:8082); defaults to $OPTIMUM_PROXIES")
+		nodeURLsFlag  = flag.String("nodes", "", "Comma-separated list of node URLs (e.g., http://localhost:9091,http://localhost:9092); defaults to $OPTIMUM_NODES")
+		proxyBase     = flag.String("proxy-base", "", "IP(s) or URL(s) for remote proxies - will prepend http:// and append -proxy-port unless a port is given")
+		nodeBase      = flag.String("node-base", "", "IP(s) or URL(s) for remote nodes (optional) - will prepend http:// and append -node-port unless a port is given")
+		proxyPort     = flag.String("proxy-port", "8080", "Port appended to -proxy-base entries that have none")
+		nodePort      = flag.String("node-port", "8081", "Port appended to -node-base entries that have none")
+		local         = flag.Bool("local", false, "Use localhost defaults (proxies: 8081,8082; nodes: 9091-9094)")
+		maxCPU        = flag.Float64("max-cpu", 0, "Exit non-zero if any reachable node or proxy exceeds this CPU % (0 disables)")
+		maxMem        = flag.Float64("max-mem", 0, "Exit non-zero if any reachable node or proxy exceeds this memory % (0 disables)")
+		maxDisk       = flag.Float64("max-disk", 0, "Exit non-zero if any reachable node or proxy exceeds this disk % (0 disables)")
+		serveAddr     = flag.String("serve", "", "Serve the dashboard as HTML on this address (e.g., :8090) instead of printing once")
+		caCert        = flag.String("cacert", "", "PEM file with CA certificates to trust for https:// endpoints")
+		skipVerify    = flag.Bool("insecure-skip-verify", false, "Skip TLS certificate verification (debugging only)")
+		statusMap     = flag.String("status-buckets", defaultStatusBuckets, "Comma-separated status=BUCKET pairs (OK, DEGRADED or DOWN) used for the summary counts; unmapped statuses of reachable endpoints count as DEGRADED")
+		timeout       = flag.Duration("timeout", 5*time.Second, "Timeout for each HTTP request to a node or proxy")
+		snapshotFile  = flag.String("snapshot", "", "Write the gathered node state to this JSON file")
+		diffFile      = flag.String("diff", "", "Print what changed since the snapshot in this JSON file (may equal -snapshot)")
+		topicDetail   = flag.String("topic-detail", "", "Also query every node's topics endpoint for this topic and print its subscribers and peers")
+	)
+	flag.Parse()
+
+	// Containerized deployments can set the URL lists through the environment;
+	// explicit flags always win.
+	if *proxyURLsFlag == "" {
+		*proxyURLsFlag = os.Getenv("OPTIMUM_PROXIES")
+	}
+	if *nodeURLsFlag == "" {
+		*nodeURLsFlag = os.Getenv("OPTIMUM_NODES")
+	}
+
+	buckets, err := parseStatusBuckets(*statusMap)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -status-buckets: %v\n", err)
+		os.Exit(1)
+	}
+	if *timeout <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -timeout must be positive\n")
+		os.Exit(1)
+	}
+	if err := fetch.Configure(*timeout, *caCert, *skipVerify); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	proxyEndpoints, nodeEndpoints := resolveEndpoints(*local, *proxyBase, *proxyPort, *proxyURLsFlag, *nodeBase, *nodePort, *nodeURLsFlag)
+	if len(proxyEndpoints) == 0 && len(nodeEndpoints) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: No proxies or nodes specified. Use -local, -proxy-base, or -proxies/-nodes flags (or OPTIMUM_PROXIES/OPTIMUM_NODES).\n")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	var nodeCountries *NodeCountries
-	if len(proxies) > 0 && proxies[0].Available {
-		nc := &NodeCountries{}
-		if err := fetchJSON(proxies[0].URL+"/api/v1/node-countries", nc); err == nil {
-			nodeCountries = nc
+	if *serveAddr != "" {
+		if err := serve(*serveAddr, proxyEndpoints, nodeEndpoints); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Load the previous snapshot before anything is written, so -diff and
+	// -snapshot can name the same file.
+	var prev *Snapshot
+	if *diffFile != "" {
+		s, err := loadSnapshot(*diffFile)
+		switch {
+		case os.IsNotExist(err):
+			fmt.Fprintf(os.Stderr, "No previous snapshot at %s, nothing to diff\n", *diffFile)
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		default:
+			prev = s
+		}
+	}
+
+	nodes, proxies, nodeCountries := gather(proxyEndpoints, nodeEndpoints)
+	printDashboard(nodes, proxies, nodeCountries, buckets)
+	if *topicDetail != "" {
+		printTopicDetail(*topicDetail, fetchTopicDetail(nodes, *topicDetail))
+	}
+
+	cur := newSnapshot(nodes)
+	if prev != nil {
+		printDiff(prev, cur)
+	}
+	if *snapshotFile != "" {
+		if err := writeSnapshot(*snapshotFile, cur); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: write snapshot: %v\n", err)
+			os.Exit(1)
 		}
 	}
 
-	printDashboard(nodes, proxies, nodeCountries)
+	thresholds := Thresholds{CPU: *maxCPU, Memory: *maxMem, Disk: *maxDisk}
+	if thresholds.enabled() && checkThresholds(nodes, proxies, thresholds) {
+		os.Exit(1)
+	}
 }
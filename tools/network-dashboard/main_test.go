@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestBaseURL(t *testing.T) {
+	tests := []struct {
+		base, port string
+		want       string
+	}{
+		{"localhost", "8081", "http://localhost:8081"},
+		{"localhost:9000", "8081", "http://localhost:9000"},
+		{"https://node.example.com", "443", "https://node.example.com:443"},
+		{"http://10.0.0.1:8080/api", "8081", "http://10.0.0.1:8080/api"},
+		{"10.0.0.1/prefix", "8081", "http://10.0.0.1:8081/prefix"},
+		{"::1", "8081", "http://[::1]:8081"},
+		{"[::1]", "8081", "http://[::1]:8081"},
+		{"[::1]:9000", "8081", "http://[::1]:9000"},
+		{"fd00::12", "8081", "http://[fd00::12]:8081"},
+		{"https://[fd00::12]/x", "8081", "https://[fd00::12]:8081/x"},
+		{"http://fe80::1:2", "8081", "http://[fe80::1:2]:8081"},
+	}
+	for _, tt := range tests {
+		if got := baseURL(tt.base, tt.port); got != tt.want {
+			t.Errorf("baseURL(%q, %q) = %q, want %q", tt.base, tt.port, got, tt.want)
+		}
+	}
+}
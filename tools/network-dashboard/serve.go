@@ -0,0 +1,107 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mump2p Network Dashboard</title>
+<style>
+body { font-family: monospace; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+th { background: #eee; }
+</style>
+</head>
+<body>
+<h1>mump2p NETWORK DASHBOARD</h1>
+<p>{{.Generated}}</p>
+{{if .Proxies}}
+<h2>PROXIES</h2>
+<table>
+<tr><th>Name</th><th>Status</th><th>CPU %</th><th>Memory %</th><th>Disk %</th><th>Country</th><th>URL</th></tr>
+{{range .Proxies}}<tr><td>{{.Name}}</td><td>{{.Status}}</td><td>{{.CPU}}</td><td>{{.Memory}}</td><td>{{.Disk}}</td><td>{{.Country}}</td><td>{{.URL}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Nodes}}
+<h2>P2P NODES</h2>
+<table>
+<tr><th>Name</th><th>Status</th><th>CPU %</th><th>Memory %</th><th>Disk %</th><th>Peers</th><th>Topics</th><th>Country</th><th>URL</th></tr>
+{{range .Nodes}}<tr><td>{{.Name}}</td><td>{{.Status}}</td><td>{{.CPU}}</td><td>{{.Memory}}</td><td>{{.Disk}}</td><td>{{.Peers}}</td><td>{{.Topics}}</td><td>{{.Country}}</td><td>{{.URL}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Countries}}
+<h2>NODE COUNTRIES</h2>
+<table>
+<tr><th>Country</th><th>Nodes</th></tr>
+{{range .Countries}}<tr><td>{{.Country}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+type countryRow struct {
+	Country string
+	Count   int
+}
+
+type dashboardPage struct {
+	Generated string
+	Proxies   []TableRow
+	Nodes     []TableRow
+	Countries []countryRow
+}
+
+func newDashboardPage(nodes []NodeInfo, proxies []ProxyInfo, nodeCountries *NodeCountries) dashboardPage {
+	page := dashboardPage{Generated: time.Now().Format("2006-01-02 15:04:05")}
+	for _, p := range proxies {
+		page.Proxies = append(page.Proxies, proxyRow(p))
+	}
+	for _, n := range nodes {
+		page.Nodes = append(page.Nodes, nodeRow(n))
+	}
+	if nodeCountries != nil && nodeCountries.Count > 0 {
+		countryCount := make(map[string]int)
+		for _, country := range nodeCountries.Countries {
+			countryCount[country]++
+		}
+		for country, count := range countryCount {
+			page.Countries = append(page.Countries, countryRow{country, count})
+		}
+		sort.Slice(page.Countries, func(i, j int) bool {
+			return page.Countries[i].Country < page.Countries[j].Country
+		})
+	}
+	return page
+}
+
+// serve exposes the dashboard as an HTML page, refetching all endpoints on every request.
+func serve(addr string, proxyEndpoints, nodeEndpoints []Endpoint) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		nodes, proxies, nodeCountries := gather(proxyEndpoints, nodeEndpoints)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardTemplate.Execute(w, newDashboardPage(nodes, proxies, nodeCountries)); err != nil {
+			log.Printf("render dashboard: %v", err)
+		}
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+	})
+
+	log.Printf("Serving dashboard on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshot is the node state written by -snapshot and compared by -diff.
+type Snapshot struct {
+	Taken time.Time `json:"taken"`
+	// Nodes is keyed by node URL, which unlike the generated name does not
+	// depend on the order of the -nodes/-node-base list.
+	Nodes map[string]NodeSnapshot `json:"nodes"`
+}
+
+type NodeSnapshot struct {
+	Name     string   `json:"name"`
+	Up       bool     `json:"up"`
+	HasState bool     `json:"hasState"`
+	Peers    []string `json:"peers,omitempty"`
+	Topics   []string `json:"topics,omitempty"`
+}
+
+func newSnapshot(nodes []NodeInfo) *Snapshot {
+	s := &Snapshot{Taken: time.Now(), Nodes: make(map[string]NodeSnapshot)}
+	for _, n := range nodes {
+		ns := NodeSnapshot{Name: n.Name, Up: n.Available}
+		if n.State != nil {
+			ns.HasState = true
+			ns.Peers = sortedCopy(n.State.Peers)
+			ns.Topics = sortedCopy(n.State.Topics)
+		}
+		s.Nodes[n.URL] = ns
+	}
+	return s
+}
+
+func sortedCopy(in []string) []string {
+	out := append([]string(nil), in...)
+	sort.Strings(out)
+	return out
+}
+
+func loadSnapshot(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func writeSnapshot(path string, s *Snapshot) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// setDiff returns the elements of b missing from a and of a missing from b.
+func setDiff(a, b []string) (added, removed []string) {
+	inA := make(map[string]bool, len(a))
+	for _, v := range a {
+		inA[v] = true
+	}
+	inB := make(map[string]bool, len(b))
+	for _, v := range b {
+		inB[v] = true
+		if !inA[v] {
+			added = append(added, v)
+		}
+	}
+	for _, v := range a {
+		if !inB[v] {
+			removed = append(removed, v)
+		}
+	}
+	return added, removed
+}
+
+func upDown(up bool) string {
+	if up {
+		return "UP"
+	}
+	return "DOWN"
+}
+
+// diffSnapshots describes, per node, what changed from prev to cur: nodes
+// that appeared, disappeared or went up or down, and peers and topics that
+// were added or removed. Peers and topics are only compared when both
+// snapshots hold the node's state.
+func diffSnapshots(prev, cur *Snapshot) []string {
+	urls := make([]string, 0, len(cur.Nodes)+len(prev.Nodes))
+	for url := range cur.Nodes {
+		urls = append(urls, url)
+	}
+	for url := range prev.Nodes {
+		if _, ok := cur.Nodes[url]; !ok {
+			urls = append(urls, url)
+		}
+	}
+	sort.Strings(urls)
+
+	var out []string
+	for _, url := range urls {
+		p, hadPrev := prev.Nodes[url]
+		c, hasCur := cur.Nodes[url]
+		switch {
+		case !hadPrev:
+			out = append(out, fmt.Sprintf("%s (%s): new node, %s", c.Name, url, upDown(c.Up)))
+			continue
+		case !hasCur:
+			out = append(out, fmt.Sprintf("%s (%s): no longer monitored", p.Name, url))
+			continue
+		case p.Up != c.Up:
+			out = append(out, fmt.Sprintf("%s (%s): %s -> %s", c.Name, url, upDown(p.Up), upDown(c.Up)))
+		}
+		if !p.HasState || !c.HasState {
+			continue
+		}
+		for _, d := range []struct {
+			what     string
+			old, new []string
+		}{{"peers", p.Peers, c.Peers}, {"topics", p.Topics, c.Topics}} {
+			added, removed := setDiff(d.old, d.new)
+			if len(added) > 0 {
+				out = append(out, fmt.Sprintf("%s (%s): %s added: %s", c.Name, url, d.what, strings.Join(added, ", ")))
+			}
+			if len(removed) > 0 {
+				out = append(out, fmt.Sprintf("%s (%s): %s removed: %s", c.Name, url, d.what, strings.Join(removed, ", ")))
+			}
+		}
+	}
+	return out
+}
+
+func printDiff(prev, cur *Snapshot) {
+	fmt.Printf("CHANGES SINCE %s\n", prev.Taken.Format("2006-01-02 15:04:05"))
+	fmt.Println(strings.Repeat("-", 100))
+	changes := diffSnapshots(prev, cur)
+	if len(changes) == 0 {
+		fmt.Println("No changes")
+	}
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+	fmt.Println()
+}
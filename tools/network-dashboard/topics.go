@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"network-dashboard/fetch"
+)
+
+// TopicDetail is a node's /api/v1/topics?topic=X&nodeinfo=true response. The
+// per-peer objects are kept raw, since their fields vary between node
+// versions, and rendered generically.
+type TopicDetail struct {
+	Topic     string            `json:"topic"`
+	PeerCount *int              `json:"peer_count"`
+	Peers     []json.RawMessage `json:"peers"`
+}
+
+// NodeTopicDetail is one node's view of the -topic-detail topic.
+type NodeTopicDetail struct {
+	Node       NodeInfo
+	Subscribed bool
+	Detail     *TopicDetail
+	Error      string
+}
+
+// fetchTopicDetail queries topic on every available node. A node is treated
+// as not subscribed if its node-state does not list the topic or its topics
+// endpoint answers 404.
+func fetchTopicDetail(nodes []NodeInfo, topic string) []NodeTopicDetail {
+	out := make([]NodeTopicDetail, 0, len(nodes))
+	for _, n := range nodes {
+		d := NodeTopicDetail{Node: n}
+		if !n.Available {
+			out = append(out, d)
+			continue
+		}
+		if n.State != nil && !containsString(n.State.Topics, topic) {
+			out = append(out, d)
+			continue
+		}
+
+		detail := &TopicDetail{}
+		err := fetch.JSON(n.URL+"/api/v1/topics?topic="+url.QueryEscape(topic)+"&nodeinfo=true", detail)
+		var statusErr *fetch.StatusError
+		switch {
+		case errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound:
+		case err != nil:
+			d.Error = err.Error()
+		default:
+			d.Subscribed = true
+			d.Detail = detail
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// renderPeer formats one peer entry: strings as-is and objects as sorted
+// key=value pairs, with list values joined by commas.
+func renderPeer(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var obj map[string]interface{}
+	if json.Unmarshal(raw, &obj) != nil {
+		return string(raw)
+	}
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := obj[k]
+		if list, ok := v.([]interface{}); ok {
+			items := make([]string, len(list))
+			for i, item := range list {
+				items[i] = fmt.Sprint(item)
+			}
+			v = strings.Join(items, ",")
+		}
+		parts = append(parts, fmt.Sprintf("%s=%v", k, v))
+	}
+	return strings.Join(parts, " ")
+}
+
+func printTopicDetail(topic string, details []NodeTopicDetail) {
+	fmt.Printf("TOPIC DETAIL: %s\n", topic)
+	fmt.Println(strings.Repeat("-", 100))
+	for _, d := range details {
+		n := d.Node
+		switch {
+		case !n.Available:
+			fmt.Printf("%s: unreachable\n", n.Name)
+			continue
+		case d.Error != "":
+			fmt.Printf("%s: topic query failed: %s\n", n.Name, d.Error)
+			continue
+		case !d.Subscribed:
+			fmt.Printf("%s: not subscribed\n", n.Name)
+			continue
+		}
+
+		peers := len(d.Detail.Peers)
+		if d.Detail.PeerCount != nil {
+			peers = *d.Detail.PeerCount
+		}
+		fmt.Printf("%s: %d peer(s)\n", n.Name, peers)
+		for _, p := range d.Detail.Peers {
+			fmt.Printf("  %s\n", renderPeer(p))
+		}
+	}
+	fmt.Println()
+}
@@ -0,0 +1,7 @@
+module topic-monitor
+
+go 1.21
+
+require network-dashboard v0.0.0
+
+replace network-dashboard => ../network-dashboard
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"network-dashboard/fetch"
+)
+
+// P2PSnapshot is the part of /api/v1/p2p-snapshot the monitor reads.
+type P2PSnapshot struct {
+	SeenMessageHashes []string `json:"seen_message_hashes"`
+}
+
+// NodeState is the part of /api/v1/node-state the monitor reads.
+type NodeState struct {
+	Topics []string `json:"topics"`
+}
+
+type Endpoint struct {
+	Name string
+	URL  string
+}
+
+// nodeSample is what one poll returned for one node.
+type nodeSample struct {
+	Endpoint
+	Hashes []string
+	Topics []string
+	Error  string
+}
+
+func sampleNode(e Endpoint) nodeSample {
+	s := nodeSample{Endpoint: e}
+	snap := &P2PSnapshot{}
+	if err := fetch.JSON(e.URL+"/api/v1/p2p-snapshot", snap); err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	state := &NodeState{}
+	if err := fetch.JSON(e.URL+"/api/v1/node-state", state); err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.Hashes = snap.SeenMessageHashes
+	s.Topics = state.Topics
+	return s
+}
+
+// TopicActivity is the result of one interval for one topic.
+type TopicActivity struct {
+	Topic     string
+	NewHashes int
+	// Quiet counts the consecutive intervals, including this one, in which
+	// the topic had no new hashes.
+	Quiet   int
+	Stalled bool
+}
+
+// Monitor tracks which message hashes have been seen across polls.
+//
+// The p2p snapshot does not say which topic a hash belongs to, so a new hash
+// is counted for every topic that the node reporting it is subscribed to. A
+// message seen by several nodes is counted once.
+type Monitor struct {
+	StallAfter int
+
+	seen map[string]bool
+	// last holds the hashes each node, by URL, reported in its last
+	// successful poll, so a node that fails a poll keeps them in seen.
+	last  map[string][]string
+	quiet map[string]int
+}
+
+func NewMonitor(stallAfter int) *Monitor {
+	return &Monitor{
+		StallAfter: stallAfter,
+		last:       make(map[string][]string),
+		quiet:      make(map[string]int),
+	}
+}
+
+// Observe records one poll. The first call only establishes the baseline and
+// returns nil; later calls return the activity of every topic any reachable
+// node is subscribed to, sorted by topic. A node's hashes are not counted as
+// new until it has answered one poll.
+func (m *Monitor) Observe(samples []nodeSample) []TopicActivity {
+	current := make(map[string]bool)
+	newByTopic := make(map[string]map[string]bool)
+	for _, s := range samples {
+		if s.Error != "" {
+			// Without this, the node's hashes would all count as new again
+			// once it recovers.
+			for _, h := range m.last[s.URL] {
+				current[h] = true
+			}
+			continue
+		}
+		// A node's first successful poll is its baseline, even after the
+		// global one: a node that was down at startup would otherwise
+		// report its whole history as new.
+		_, known := m.last[s.URL]
+		m.last[s.URL] = s.Hashes
+		for _, t := range s.Topics {
+			if newByTopic[t] == nil {
+				newByTopic[t] = make(map[string]bool)
+			}
+		}
+		for _, h := range s.Hashes {
+			current[h] = true
+			if !known || m.seen[h] {
+				continue
+			}
+			for _, t := range s.Topics {
+				newByTopic[t][h] = true
+			}
+		}
+	}
+
+	baseline := m.seen == nil
+	m.seen = current
+	if baseline {
+		return nil
+	}
+
+	topics := make([]string, 0, len(newByTopic))
+	for t := range newByTopic {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+
+	out := make([]TopicActivity, 0, len(topics))
+	for _, t := range topics {
+		a := TopicActivity{Topic: t, NewHashes: len(newByTopic[t])}
+		if a.NewHashes == 0 {
+			m.quiet[t]++
+		} else {
+			m.quiet[t] = 0
+		}
+		a.Quiet = m.quiet[t]
+		a.Stalled = m.StallAfter > 0 && a.Quiet >= m.StallAfter
+		out = append(out, a)
+	}
+	// Forget topics no node reports any more, so a topic that comes back
+	// starts counting from zero.
+	for t := range m.quiet {
+		if _, ok := newByTopic[t]; !ok {
+			delete(m.quiet, t)
+		}
+	}
+	return out
+}
+
+func printActivity(now time.Time, interval time.Duration, samples []nodeSample, activity []TopicActivity) {
+	fmt.Printf("%s  (interval %v)\n", now.Format("2006-01-02 15:04:05"), interval)
+	for _, s := range samples {
+		if s.Error != "" {
+			fmt.Printf("  %s (%s) unreachable: %s\n", s.Name, s.URL, s.Error)
+		}
+	}
+	if len(activity) == 0 {
+		fmt.Println("  No topics reported")
+		fmt.Println()
+		return
+	}
+
+	fmt.Printf("  %-30s %10s %10s  %s\n", "TOPIC", "NEW", "MSG/S", "STATUS")
+	var stalled []string
+	for _, a := range activity {
+		status := "active"
+		switch {
+		case a.Stalled:
+			status = fmt.Sprintf("STALLED (no new hashes for %d intervals)", a.Quiet)
+			stalled = append(stalled, a.Topic)
+		case a.NewHashes == 0:
+			status = "quiet"
+		}
+		rate := float64(a.NewHashes) / interval.Seconds()
+		fmt.Printf("  %-30s %10d %10.2f  %s\n", a.Topic, a.NewHashes, rate, status)
+	}
+	if len(stalled) > 0 {
+		fmt.Printf("  Potentially stalled: %s\n", strings.Join(stalled, ", "))
+	}
+	fmt.Println()
+}
+
+func parseNodes(local bool, urls string) []Endpoint {
+	if local {
+		return []Endpoint{
+			{"p2pnode-1", "http://localhost:9091"},
+			{"p2pnode-2", "http://localhost:9092"},
+			{"p2pnode-3", "http://localhost:9093"},
+			{"p2pnode-4", "http://localhost:9094"},
+		}
+	}
+	var nodes []Endpoint
+	for i, url := range strings.Split(urls, ",") {
+		url = strings.TrimSpace(url)
+		if url == "" {
+			continue
+		}
+		nodes = append(nodes, Endpoint{fmt.Sprintf("p2pnode-%d", i+1), url})
+	}
+	return nodes
+}
+
+func main() {
+	var (
+		nodeURLs   = flag.String("nodes", "", "Comma-separated list of node API URLs (e.g., http://localhost:9091,http://localhost:9092); defaults to $OPTIMUM_NODES")
+		local      = flag.Bool("local", false, "Use the localhost node APIs (9091-9094)")
+		interval   = flag.Duration("interval", 10*time.Second, "How often to poll every node")
+		stallAfter = flag.Int("stall-after", 3, "Report a topic as potentially stalled after this many consecutive intervals without new hashes (0 disables)")
+		count      = flag.Int("count", 0, "Exit after reporting this many intervals (0 runs until interrupted)")
+		caCert     = flag.String("cacert", "", "PEM file with CA certificates to trust for https:// endpoints")
+		skipVerify = flag.Bool("insecure-skip-verify", false, "Skip TLS certificate verification (debugging only)")
+		timeout    = flag.Duration("timeout", 5*time.Second, "Timeout for each HTTP request to a node")
+	)
+	flag.Parse()
+
+	if *nodeURLs == "" {
+		*nodeURLs = os.Getenv("OPTIMUM_NODES")
+	}
+	if *interval <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -interval must be positive\n")
+		os.Exit(1)
+	}
+	if *stallAfter < 0 || *count < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -stall-after and -count must not be negative\n")
+		os.Exit(1)
+	}
+	if *timeout <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -timeout must be positive\n")
+		os.Exit(1)
+	}
+	if err := fetch.Configure(*timeout, *caCert, *skipVerify); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	nodes := parseNodes(*local, *nodeURLs)
+	if len(nodes) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: No nodes specified. Use -local or -nodes (or OPTIMUM_NODES).\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	poll := func() []nodeSample {
+		samples := make([]nodeSample, len(nodes))
+		for i, e := range nodes {
+			samples[i] = sampleNode(e)
+		}
+		return samples
+	}
+
+	m := NewMonitor(*stallAfter)
+	m.Observe(poll())
+	fmt.Printf("Monitoring %d node(s) every %v\n\n", len(nodes), *interval)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for reported := 0; *count == 0 || reported < *count; reported++ {
+		select {
+		case <-sig:
+			return
+		case now := <-ticker.C:
+			samples := poll()
+			printActivity(now, *interval, samples, m.Observe(samples))
+		}
+	}
+}
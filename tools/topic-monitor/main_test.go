@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func sample(url string, topics []string, hashes ...string) nodeSample {
+	return nodeSample{Endpoint: Endpoint{Name: url, URL: url}, Topics: topics, Hashes: hashes}
+}
+
+func failed(url string) nodeSample {
+	return nodeSample{Endpoint: Endpoint{Name: url, URL: url}, Error: "connection refused"}
+}
+
+func TestMonitorObserve(t *testing.T) {
+	ab := []string{"a", "b"}
+	polls := []struct {
+		name    string
+		samples []nodeSample
+		want    []TopicActivity
+	}{
+		{"baseline", []nodeSample{sample("n1", ab, "h1"), sample("n2", []string{"b"}, "h2")}, nil},
+		{"new hash on n1", []nodeSample{sample("n1", ab, "h1", "h3"), sample("n2", []string{"b"}, "h2")},
+			[]TopicActivity{{Topic: "a", NewHashes: 1}, {Topic: "b", NewHashes: 1}}},
+		{"n2 fails", []nodeSample{sample("n1", ab, "h1", "h3"), failed("n2")},
+			[]TopicActivity{{Topic: "a", Quiet: 1}, {Topic: "b", Quiet: 1}}},
+		{"n2 recovers with its old hashes", []nodeSample{sample("n1", ab, "h1", "h3"), sample("n2", []string{"b"}, "h2")},
+			[]TopicActivity{{Topic: "a", Quiet: 2, Stalled: true}, {Topic: "b", Quiet: 2, Stalled: true}}},
+		{"message seen by both counts once", []nodeSample{sample("n1", ab, "h4"), sample("n2", []string{"b"}, "h2", "h4")},
+			[]TopicActivity{{Topic: "a", NewHashes: 1}, {Topic: "b", NewHashes: 1}}},
+		{"topic a gone", []nodeSample{sample("n1", []string{"b"}, "h4"), sample("n2", []string{"b"}, "h4")},
+			[]TopicActivity{{Topic: "b", Quiet: 1}}},
+		{"topic a back", []nodeSample{sample("n1", ab, "h4"), sample("n2", []string{"b"}, "h4")},
+			[]TopicActivity{{Topic: "a", Quiet: 1}, {Topic: "b", Quiet: 2, Stalled: true}}},
+	}
+
+	m := NewMonitor(2)
+	for _, p := range polls {
+		if got := m.Observe(p.samples); !reflect.DeepEqual(got, p.want) {
+			t.Fatalf("%s: Observe = %+v, want %+v", p.name, got, p.want)
+		}
+	}
+}
+
+// TestMonitorObserveLateNode checks that a node down for the baseline poll
+// does not count its existing hashes as new when it first answers.
+func TestMonitorObserveLateNode(t *testing.T) {
+	polls := []struct {
+		name    string
+		samples []nodeSample
+		want    []TopicActivity
+	}{
+		{"baseline without n2", []nodeSample{sample("n1", []string{"a"}, "h1"), failed("n2")}, nil},
+		{"n2 first answers", []nodeSample{sample("n1", []string{"a"}, "h1"), sample("n2", []string{"a", "b"}, "h2", "h3")},
+			[]TopicActivity{{Topic: "a", Quiet: 1}, {Topic: "b", Quiet: 1}}},
+		{"new hash on n2", []nodeSample{sample("n1", []string{"a"}, "h1"), sample("n2", []string{"a", "b"}, "h2", "h3", "h4")},
+			[]TopicActivity{{Topic: "a", NewHashes: 1}, {Topic: "b", NewHashes: 1}}},
+	}
+
+	m := NewMonitor(2)
+	for _, p := range polls {
+		if got := m.Observe(p.samples); !reflect.DeepEqual(got, p.want) {
+			t.Fatalf("%s: Observe = %+v, want %+v", p.name, got, p.want)
+		}
+	}
+}